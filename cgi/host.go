@@ -32,9 +32,17 @@ import (
 	"github.com/shynome/go-wagi/fsnet"
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/sys"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/http/httpguts"
 )
 
+var tracer = otel.Tracer("github.com/shynome/go-wagi/cgi")
+
 var trailingPort = regexp.MustCompile(`:([0-9]+)$`)
 
 // Handler runs an executable in a subprocess with a CGI environment.
@@ -45,6 +53,9 @@ type Handler struct {
 	Runtime wazero.Runtime
 	WASM    wazero.CompiledModule
 
+	// Restore 不为空时在实例化后, 调用 _start 前调用, 用于从快照恢复内存
+	Restore func(ctx context.Context, mod api.Module) error
+
 	// Dir specifies the CGI executable's working directory.
 	// If Dir is empty, the base directory of Path is used.
 	// If Path has no base directory, the current working
@@ -180,6 +191,19 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		env = append(env, h.Env...)
 	}
 
+	ctx, span := tracer.Start(req.Context(), "cgi.run", trace.WithAttributes(
+		attribute.String("wagi.script", h.Path),
+	))
+	defer span.End()
+
+	// Propagate the trace context to the guest as HTTP_TRACEPARENT etc.,
+	// overriding the ones received from the client.
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	for k, v := range carrier {
+		env = append(env, "HTTP_"+strings.Map(upperCaseAndUnderscore, k)+"="+v)
+	}
+
 	env = removeLeadingDuplicates(env)
 
 	var cwd, path string
@@ -220,6 +244,7 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	mc = mc.WithArgs(h.Args...)
 	fsc := wazero.NewFSConfig()
 	fsc = fsc.WithDirMount(cwd, cwd)
+	fsc = WithMounts(fsc, envMap["WASI_MOUNTS"])
 	if rule := envMap["WASI_NET"]; rule != "" {
 		fsc = fsc.WithFSMount(fsnet.New(rule), "/dev")
 	}
@@ -235,18 +260,27 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	stdoutRead, stdout := io.Pipe()
 	mc = mc.WithStdout(stdout)
 
-	ctx := req.Context()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	go func() {
 		defer stdout.Close()
 		mc := mc.WithName("")
+		if h.Restore != nil {
+			mc = mc.WithStartFunctions()
+		}
 		mod, err := h.Runtime.InstantiateModule(ctx, h.WASM, mc)
+		if err == nil {
+			defer mod.Close(ctx)
+			if h.Restore != nil {
+				err = h.start(ctx, mod)
+			}
+		}
 		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
 			return
 		}
-		defer mod.Close(ctx)
 		if hook := testHookStartProcess; hook != nil {
 			hook(mod)
 		}
@@ -355,6 +389,22 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// start 恢复快照后调用 _start
+func (h *Handler) start(ctx context.Context, mod api.Module) error {
+	if err := h.Restore(ctx, mod); err != nil {
+		return err
+	}
+	start := mod.ExportedFunction("_start")
+	if start == nil {
+		return nil
+	}
+	_, err := start.Call(ctx)
+	if exit, ok := err.(*sys.ExitError); ok && exit.ExitCode() == 0 {
+		return nil
+	}
+	return err
+}
+
 func (h *Handler) printf(format string, v ...any) {
 	if h.Logger != nil {
 		h.Logger.Printf(format, v...)
@@ -393,6 +443,11 @@ func (h *Handler) handleInternalRedirect(rw http.ResponseWriter, req *http.Reque
 	h.PathLocationHandler.ServeHTTP(rw, newReq)
 }
 
+// EnvKey 将请求头的名称转换为 cgi 环境变量的名称 (不含 HTTP_ 前缀), 如 X-Request-Id 转换为 X_REQUEST_ID
+func EnvKey(header string) string {
+	return strings.Map(upperCaseAndUnderscore, header)
+}
+
 func upperCaseAndUnderscore(r rune) rune {
 	switch {
 	case r >= 'a' && r <= 'z':
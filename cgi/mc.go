@@ -2,6 +2,7 @@ package cgi
 
 import (
 	"crypto/rand"
+	"strings"
 
 	"github.com/tetratelabs/wazero"
 )
@@ -14,3 +15,24 @@ func WithCommonConfig(mc wazero.ModuleConfig) wazero.ModuleConfig {
 		WithSysWalltime()
 
 }
+
+// WithMounts 按 WASI_MOUNTS 参数挂载目录, 格式为逗号分隔的 `host:guest[:ro]`
+func WithMounts(fsc wazero.FSConfig, spec string) wazero.FSConfig {
+	for _, m := range strings.Split(spec, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		parts := strings.Split(m, ":")
+		host, guest := parts[0], parts[0]
+		if len(parts) > 1 && parts[1] != "" {
+			guest = parts[1]
+		}
+		if len(parts) > 2 && parts[2] == "ro" {
+			fsc = fsc.WithReadOnlyDirMount(host, guest)
+		} else {
+			fsc = fsc.WithDirMount(host, guest)
+		}
+	}
+	return fsc
+}
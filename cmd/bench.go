@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shynome/err0"
+	"github.com/shynome/err0/try"
+	"github.com/shynome/go-wagi/wagi"
+	"github.com/spf13/cobra"
+)
+
+var benchArgs struct {
+	requestArgs
+	requests    int
+	concurrency int
+	modes       []string
+}
+
+type benchResult struct {
+	Mode     string
+	Requests int
+	Errors   int64
+	Duration time.Duration
+	// 首个请求的耗时, 包含编译 (如果没有缓存) 和实例化
+	First       time.Duration
+	Latencies   []time.Duration
+	HeapAlloc   uint64 // 结束时的 HeapAlloc
+	TotalAlloc  uint64 // 压测期间累计分配
+	MemoryPages uint32 // wcgi guest 线性内存页数
+}
+
+func (r *benchResult) QPS() float64 {
+	return float64(r.Requests) / r.Duration.Seconds()
+}
+
+func (r *benchResult) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.Latencies)-1) * p)
+	return r.Latencies[i]
+}
+
+var benchCmd = &cobra.Command{
+	Use:   "bench <script>",
+	Short: "在进程内压测脚本, 对比 cgi 和 wcgi 模式的性能",
+	Example: `  go-wagi bench ./example/index.php -n 2000 -c 50
+  go-wagi bench ./example/index.php --mode wcgi --path /hello1`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, _args []string) (err error) {
+		defer err0.Then(&err, nil, nil)
+
+		if benchArgs.requests < 1 || benchArgs.concurrency < 1 {
+			return errors.New("-n and -c must be at least 1")
+		}
+		env, body := try.To2(benchArgs.build(_args[0]))
+
+		ctx := context.Background()
+		s := try.To1(wagi.New(ctx, try.To1(serverOptions())...))
+		defer s.Close(ctx)
+
+		out := cmd.OutOrStdout()
+		var results []*benchResult
+		for _, mode := range benchArgs.modes {
+			env := maps.Clone(env)
+			switch mode {
+			case "cgi":
+				env["WASI_CGI"] = "true"
+			case "wcgi":
+				delete(env, "WASI_CGI")
+			default:
+				return fmt.Errorf("unknown mode: %s", mode)
+			}
+			result, err := runBench(ctx, s, mode, env, body)
+			if errors.Is(err, errWCGIUnsupported) {
+				fmt.Fprintf(out, "skip wcgi: %s\n", err)
+				continue
+			}
+			try.To(err)
+			info, _ := s.Script(env["SCRIPT_FILENAME"])
+			if mode == "wcgi" {
+				if info.WCGI != nil {
+					result.MemoryPages = info.WCGI.MemoryPages
+					fmt.Fprintf(out, "wcgi instantiate: %s\n", info.WCGI.StartupTime)
+				}
+			}
+			if info.Module != nil && len(results) == 0 {
+				fmt.Fprintf(out, "compile: %s\n", info.Module.CompileTime)
+			}
+			results = append(results, result)
+		}
+
+		fmt.Fprintln(out)
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "MODE\tREQUESTS\tERRORS\tQPS\tFIRST\tP50\tP90\tP99\tMAX\tHEAP\tALLOC/REQ\tGUEST MEM\t")
+		for _, r := range results {
+			guest := "-"
+			if r.MemoryPages > 0 {
+				guest = formatSize(int64(r.MemoryPages) * 65536)
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n",
+				r.Mode, r.Requests, r.Errors, r.QPS(),
+				r.First.Round(time.Microsecond),
+				r.Percentile(0.5).Round(time.Microsecond),
+				r.Percentile(0.9).Round(time.Microsecond),
+				r.Percentile(0.99).Round(time.Microsecond),
+				r.Percentile(1).Round(time.Microsecond),
+				formatSize(int64(r.HeapAlloc)),
+				formatSize(int64(r.TotalAlloc)/int64(r.Requests)),
+				guest,
+			)
+		}
+		return w.Flush()
+	},
+}
+
+var errWCGIUnsupported = errors.New("not supported, the module does not export wagi_wcgi")
+
+// runBench 先发送一个请求预热, 然后以 concurrency 个并发发送 requests 个请求.
+// wcgi 模式下模块不支持 wcgi 时返回 errWCGIUnsupported
+func runBench(ctx context.Context, s *wagi.Server, mode string, env map[string]string, body []byte) (*benchResult, error) {
+	do := func() (time.Duration, bool, error) {
+		r, env, err := newRequest(ctx, env, body)
+		if err != nil {
+			return 0, false, err
+		}
+		w := httptest.NewRecorder()
+		start := time.Now()
+		s.ServeParams(w, r, env)
+		d := time.Since(start)
+		io.Copy(io.Discard, w.Result().Body)
+		return d, w.Code < 400, nil
+	}
+
+	result := &benchResult{
+		Mode:      mode,
+		Requests:  benchArgs.requests,
+		Latencies: make([]time.Duration, benchArgs.requests),
+	}
+	first, ok, err := do()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s: the warm up request failed", mode)
+	}
+	result.First = first
+	// 不支持 wcgi 的模块会以 cgi 模式运行, 结果没有意义
+	if info, _ := s.Script(env["SCRIPT_FILENAME"]); mode == "wcgi" && info.Module != nil && !info.Module.SupportWCGI {
+		return nil, errWCGIUnsupported
+	}
+
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range benchArgs.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := next.Add(1) - 1
+				if i >= int64(benchArgs.requests) {
+					return
+				}
+				d, ok, _ := do()
+				result.Latencies[i] = d
+				if !ok {
+					atomic.AddInt64(&result.Errors, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	result.Duration = time.Since(start)
+
+	runtime.ReadMemStats(&after)
+	result.HeapAlloc = after.HeapAlloc
+	result.TotalAlloc = after.TotalAlloc - before.TotalAlloc
+	slices.Sort(result.Latencies)
+	return result, nil
+}
+
+func init() {
+	f := benchCmd.Flags()
+	benchArgs.addFlags(f)
+	f.IntVarP(&benchArgs.requests, "requests", "n", 1000, "number of requests to perform in each mode")
+	f.IntVarP(&benchArgs.concurrency, "concurrency", "c", 10, "number of requests to perform concurrently")
+	f.StringSliceVar(&benchArgs.modes, "mode", []string{"cgi", "wcgi"}, "modes to benchmark")
+	rootCmd.AddCommand(benchCmd)
+}
@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shynome/err0"
+	"github.com/shynome/err0/try"
+	"github.com/shynome/go-wagi/wagi"
+	"github.com/spf13/cobra"
+)
+
+// cacheEntry 是 wazero 编译缓存或下载的远程模块中的一项, 文件名为模块内容的 hash, 无法反查脚本路径
+type cacheEntry struct {
+	Version string // wazero-<version>-<arch>-<os>, 下载的模块为 modules
+	Key     string
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// modulesDir 是 dir 下保存 http(s):// 和 oci:// 模块的子目录, 见 newResolver
+const modulesDir = "modules"
+
+// listCacheEntries 列出 dir 下所有 wazero 版本的编译缓存和下载的模块
+func listCacheEntries(dir string) ([]cacheEntry, error) {
+	var entries []cacheEntry
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(d.Name(), ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		version, key, ok := strings.Cut(filepath.ToSlash(rel), "/")
+		if !ok || !strings.HasPrefix(version, "wazero-") && version != modulesDir {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, cacheEntry{
+			Version: version,
+			Key:     key,
+			Path:    path,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	return entries, err
+}
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "管理 wazero 编译缓存和下载的模块",
+}
+
+var cacheLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "列出编译缓存",
+	RunE: func(cmd *cobra.Command, _args []string) (err error) {
+		defer err0.Then(&err, nil, nil)
+		entries := try.To1(listCacheEntries(args.cacheDir))
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DIR\tKEY\tSIZE\tMODIFIED")
+		var total int64
+		for _, e := range entries {
+			total += e.Size
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Version, e.Key, formatSize(e.Size), e.ModTime.Format(time.DateTime))
+		}
+		try.To(w.Flush())
+		fmt.Fprintf(cmd.OutOrStdout(), "%d entries, %s total\n", len(entries), formatSize(total))
+		return
+	},
+}
+
+var cachePruneArgs struct {
+	olderThan time.Duration
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "删除过期的编译缓存, 下载的模块以及其他 wazero 版本的缓存",
+	Long: `删除修改时间早于 --older-than 的编译缓存和下载的模块, 删除的模块在下次使用时会重新下载.
+其他 wazero 版本生成的缓存无法被当前版本使用, 也会一并删除. 删除后为空的目录也会被删除`,
+	RunE: func(cmd *cobra.Command, _args []string) (err error) {
+		defer err0.Then(&err, nil, nil)
+		current := currentCacheVersion()
+		deadline := time.Now().Add(-cachePruneArgs.olderThan)
+		entries := try.To1(listCacheEntries(args.cacheDir))
+		var (
+			count int
+			freed int64
+		)
+		for _, e := range entries {
+			if (e.Version == current || e.Version == modulesDir) && e.ModTime.After(deadline) {
+				continue
+			}
+			try.To(os.Remove(e.Path))
+			count++
+			freed += e.Size
+		}
+		removeEmptyDirs(args.cacheDir)
+		fmt.Fprintf(cmd.OutOrStdout(), "removed %d entries, freed %s\n", count, formatSize(freed))
+		return
+	},
+}
+
+var cacheWarmCmd = &cobra.Command{
+	Use:   "warm <files>...",
+	Short: "预先编译 wasm 文件并写入缓存",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, _args []string) (err error) {
+		defer err0.Then(&err, nil, nil)
+		ctx := context.Background()
+		rt := try.To1(wagi.NewRuntime(ctx, nil, args.cacheDir))
+		defer rt.Close(ctx)
+		for _, file := range _args {
+			start := time.Now()
+			mod := getWASMTry(ctx, rt, file)
+			mod.Close(ctx)
+			fmt.Fprintf(cmd.OutOrStdout(), "%s\t%s\n", file, time.Since(start))
+		}
+		return
+	},
+}
+
+var cacheClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "清空编译缓存和下载的模块",
+	RunE: func(cmd *cobra.Command, _args []string) (err error) {
+		defer err0.Then(&err, nil, nil)
+		entries := try.To1(listCacheEntries(args.cacheDir))
+		for _, e := range entries {
+			try.To(os.Remove(e.Path))
+		}
+		removeEmptyDirs(args.cacheDir)
+		fmt.Fprintf(cmd.OutOrStdout(), "removed %d entries\n", len(entries))
+		return
+	},
+}
+
+// removeEmptyDirs 删除 dir 下已经为空的编译缓存和模块目录, 其他目录和文件不受影响
+func removeEmptyDirs(dir string) {
+	entries, _ := os.ReadDir(dir)
+	for _, d := range entries {
+		if d.IsDir() && (strings.HasPrefix(d.Name(), "wazero-") || d.Name() == modulesDir) {
+			// 目录不为空时删除失败
+			os.Remove(filepath.Join(dir, d.Name()))
+		}
+	}
+}
+
+// currentCacheVersion 返回当前 wazero 版本使用的缓存子目录名, 与 wazero 的命名规则一致
+func currentCacheVersion() string {
+	version := "dev"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/tetratelabs/wazero" {
+				version = dep.Version
+			}
+		}
+	}
+	return "wazero-" + version + "-" + runtime.GOARCH + "-" + runtime.GOOS
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func init() {
+	cachePruneCmd.Flags().DurationVar(&cachePruneArgs.olderThan, "older-than", 30*24*time.Hour, "remove entries not modified within this duration")
+	cacheCmd.AddCommand(cacheLsCmd, cachePruneCmd, cacheWarmCmd, cacheClearCmd)
+	rootCmd.AddCommand(cacheCmd)
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/shynome/go-wagi/wagi"
+	"gopkg.in/yaml.v3"
+)
+
+// Config 是 --config 指定的配置文件
+//
+//	routes:
+//	  - path: /api
+//	    host: api.example.com
+//	    methods: [GET, POST]
+//	    module: ./api.wasm
+//	    root: ./data
+//	    env: { FOO: bar }
+//	    mounts: [/tmp:/tmp]
+//	    net: bypass=127.0.0.1
+//	    mode: wcgi
+//	hosts:
+//	  - names: [a.example.com, "*.a.example.com"]
+//	    root: /srv/a
+//	    script: index.wasm
+//	    net: bypass=127.0.0.1
+//	    env: { TENANT: a }
+//	    limits: { timeout: 30s, max_body_size: 10485760 }
+//	limits:
+//	  script: { rate: 100, burst: 200, max_concurrent: 10, max_queue: 100, queue_timeout: 5s }
+//	  host: { max_concurrent: 50 }
+//	  client: { rate: 10 }
+type Config struct {
+	Routes []wagi.Route       `yaml:"routes"`
+	Hosts  []wagi.VirtualHost `yaml:"hosts"`
+	Limits wagi.RateLimits    `yaml:"limits"`
+}
+
+func loadConfig(file string) (*Config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	for i := range cfg.Routes {
+		if err := cfg.Routes[i].Validate(); err != nil {
+			return nil, err
+		}
+	}
+	for i := range cfg.Hosts {
+		if err := cfg.Hosts[i].Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &cfg, nil
+}
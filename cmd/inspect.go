@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/shynome/err0"
+	"github.com/shynome/err0/try"
+	"github.com/shynome/go-wagi/wagi"
+	"github.com/spf13/cobra"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <script>",
+	Short: "查看 wasm 模块的导出导入, 内存声明以及是否兼容 go-wagi",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, _args []string) (err error) {
+		defer err0.Then(&err, nil, nil)
+
+		ctx := context.Background()
+		// 只需要解析模块, 解释器编译更快
+		rtc := wazero.NewRuntimeConfigInterpreter().WithCustomSections(true)
+		rt := wazero.NewRuntimeWithConfig(ctx, rtc)
+		defer rt.Close(ctx)
+		wasi_snapshot_preview1.MustInstantiate(ctx, rt)
+
+		binary := try.To1(os.ReadFile(_args[0]))
+		mod := try.To1(rt.CompileModule(ctx, binary))
+		defer mod.Close(ctx)
+
+		out := cmd.OutOrStdout()
+		problems := printModule(out, rt, mod)
+
+		mode := "cgi"
+		if wagi.SupportWCGI(mod) {
+			mode = "wcgi"
+		}
+		fmt.Fprintf(out, "\nmode: %s\n", mode)
+		if len(problems) == 0 {
+			fmt.Fprintln(out, "verdict: compatible")
+			return
+		}
+		fmt.Fprintln(out, "verdict: incompatible")
+		for _, p := range problems {
+			fmt.Fprintf(out, "  - %s\n", p)
+		}
+		return fmt.Errorf("%s is not compatible with go-wagi", _args[0])
+	},
+}
+
+// printModule 输出模块信息, 返回与 go-wagi 宿主不兼容的原因
+func printModule(out io.Writer, rt wazero.Runtime, mod wazero.CompiledModule) (problems []string) {
+	fmt.Fprintln(out, "imports:")
+	for _, f := range mod.ImportedFunctions() {
+		moduleName, name, _ := f.Import()
+		sig := funcSignature(f)
+		fmt.Fprintf(out, "  %s.%s %s\n", moduleName, name, sig)
+
+		host := rt.Module(moduleName)
+		if host == nil {
+			problems = append(problems, fmt.Sprintf("unknown import module %s (%s)", moduleName, name))
+			continue
+		}
+		def, ok := host.ExportedFunctionDefinitions()[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s.%s is not provided by the host", moduleName, name))
+			continue
+		}
+		if hostSig := funcSignature(def); hostSig != sig {
+			problems = append(problems, fmt.Sprintf("%s.%s signature mismatch, host is %s", moduleName, name, hostSig))
+		}
+	}
+	for _, m := range mod.ImportedMemories() {
+		moduleName, name, _ := m.Import()
+		fmt.Fprintf(out, "  %s.%s memory %s\n", moduleName, name, memoryLimits(m))
+		problems = append(problems, fmt.Sprintf("imported memory %s.%s is not provided by the host", moduleName, name))
+	}
+
+	fmt.Fprintln(out, "exports:")
+	exports := mod.ExportedFunctions()
+	for _, name := range slices.Sorted(maps.Keys(exports)) {
+		fmt.Fprintf(out, "  %s %s\n", name, funcSignature(exports[name]))
+	}
+	_, command := exports["_start"]
+	_, reactor := exports["_initialize"]
+	if !command && !reactor {
+		problems = append(problems, "neither _start nor _initialize is exported")
+	}
+
+	fmt.Fprintln(out, "memories:")
+	memories := mod.ExportedMemories()
+	for _, name := range slices.Sorted(maps.Keys(memories)) {
+		fmt.Fprintf(out, "  %s %s\n", name, memoryLimits(memories[name]))
+	}
+	if len(memories) == 0 {
+		problems = append(problems, "no memory is exported")
+	}
+
+	fmt.Fprintln(out, "custom sections:")
+	for _, s := range mod.CustomSections() {
+		fmt.Fprintf(out, "  %s %s\n", s.Name(), formatSize(int64(len(s.Data()))))
+	}
+	return
+}
+
+func funcSignature(f api.FunctionDefinition) string {
+	types := func(vt []api.ValueType) string {
+		names := make([]string, len(vt))
+		for i, t := range vt {
+			names[i] = api.ValueTypeName(t)
+		}
+		return strings.Join(names, ", ")
+	}
+	return fmt.Sprintf("func(%s) (%s)", types(f.ParamTypes()), types(f.ResultTypes()))
+}
+
+func memoryLimits(m api.MemoryDefinition) string {
+	max := "unlimited"
+	if n, ok := m.Max(); ok {
+		max = fmt.Sprintf("%d pages (%s)", n, formatSize(int64(n)*65536))
+	}
+	return fmt.Sprintf("min %d pages (%s), max %s", m.Min(), formatSize(int64(m.Min())*65536), max)
+}
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+}
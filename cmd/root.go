@@ -5,33 +5,69 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/http/fcgi"
-	"net/http/httputil"
-	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/hashicorp/yamux"
-	"github.com/shynome/err0"
 	"github.com/shynome/err0/try"
-	"github.com/shynome/go-wagi/cgi"
-	"github.com/shynome/go-wagi/fsnet"
-	"github.com/shynome/wcgi"
+	"github.com/shynome/go-wagi/wagi"
 	"github.com/spf13/cobra"
 	"github.com/tetratelabs/wazero"
-	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
 )
 
 var args struct {
-	listen string
+	listen     string
+	protocol   string
+	config     string
+	cacheDir   string
+	scriptsDir string
+	static     bool
+	engine     string
+	snapshot   bool
+
+	responseCacheSize int
+	responseCacheDir  string
+
+	maxInstances int
+	maxCGI       int
+	maxMemory    int
+
+	maxModules         int
+	maxModuleSize      int
+	maxScripts         int
+	maxCachedInstances int
+
+	healthInterval time.Duration
+	healthTimeout  time.Duration
+	healthPath     string
+
+	recycleRequests int
+	recycleAge      time.Duration
+	recycleMemory   int
+
+	compress        []string
+	compressMinSize int
+	compressTypes   []string
+
+	ociInterval  time.Duration
+	ociPlainHTTP []string
+
+	logDir        string
+	logMaxSize    int
+	logMaxBackups int
+
+	trace string
+
+	adminListen string
+	adminToken  string
 }
 
 // rootCmd represents the base command when called without any subcommands
@@ -47,252 +83,163 @@ var rootCmd = &cobra.Command{
 		defer l.Close()
 
 		ctx := context.Background()
-		waCache := try.To1(wazero.NewCompilationCacheWithDir(".wazero"))
-		rtc := wazero.NewRuntimeConfig().
-			WithCompilationCache(waCache).
-			WithCloseOnContextDone(true)
-		rt := wazero.NewRuntimeWithConfig(ctx, rtc)
-		wasi_snapshot_preview1.MustInstantiate(ctx, rt)
-
-		mCache := newCache[func() (*WasmItem, error)]()
-		proxyCache := newCache[func() (*ProxyItem, error)]()
-		instCache := newCache[*InstanceItem]()
-
-		var keepAlive = 10 * time.Minute
-		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			var err error
-			defer err0.Then(&err, nil, func() {
-				log.Println("err", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-			})
-
-			env := fcgi.ProcessEnv(r)
-			script := env["SCRIPT_FILENAME"]
-			cwd := env["DOCUMENT_ROOT"]
-			finfo := try.To1(os.Stat(script))
-
-			fileKey := "file-" + script
-			wasmKey := fmt.Sprintf("file-%s-%d", script, finfo.ModTime().Unix())
-			netRule := env["WASI_NET"]
-			proxyKey := strings.Join([]string{wasmKey, env["WASI_DEBUG"], cwd, netRule}, ",")
-
-			inst := instCache.Get(fileKey)
-			if inst == nil {
-				func() {
-					instCache.mux.Lock()
-					defer instCache.mux.Unlock()
-					ctx := context.Background()
-					ctx, cancel := context.WithCancel(ctx)
-					timer := time.AfterFunc(keepAlive, func() {
-						cancel()
-					})
-					go func() {
-						<-ctx.Done()
-						instCache.Del(fileKey)
-					}()
-					inst = &InstanceItem{
-						WasmKey:  wasmKey,
-						ProxyKey: proxyKey,
-						timer:    timer,
-						ctx:      ctx,
-					}
-				}()
-				instCache.Set(fileKey, inst)
-			} else {
-				inst.timer.Reset(keepAlive)
-			}
-
-			wasmGet := mCache.Get(wasmKey)
-			proxyGet := proxyCache.Get(proxyKey)
-			func() {
-				instCache.mux.RLock()
-				defer instCache.mux.RUnlock()
-
-				// clear old wasm module
-				func() {
-					if inst.WasmKey == wasmKey {
-						return
-					}
-					wasmGet := mCache.Get(inst.WasmKey)
-					if wasmGet == nil {
-						return
-					}
-					if mod, err := wasmGet(); err == nil {
-						mod.Close()
-					}
-					mCache.Del(wasmKey)
-				}()
-				// clear old proxy instance
-				func() {
-					if inst.ProxyKey == proxyKey {
-						return
-					}
-					proxyGet := proxyCache.Get(inst.ProxyKey)
-					if proxyGet == nil {
-						return
-					}
-					if proxy, err := proxyGet(); err == nil {
-						proxy.Close()
-					}
-					mCache.Del(proxyKey)
-				}()
-				inst.WasmKey = wasmKey
-				inst.ProxyKey = proxyKey
-			}()
-
-			if wasmGet == nil {
-				wasmGet = sync.OnceValues(func() (*WasmItem, error) {
-					binary, err := os.ReadFile(script)
-					if err != nil {
-						return nil, err
-					}
-					ctx := inst.ctx
-					ctx2, timeout := context.WithTimeout(ctx, 3*time.Minute)
-					defer timeout()
-					mod, err := rt.CompileModule(ctx2, binary)
-					if err != nil {
-						return nil, err
-					}
-					ctx, cancel := context.WithCancel(ctx)
-					go func() {
-						<-ctx.Done()
-						mCache.Del(wasmKey)
-						mod.Close(ctx)
-					}()
-					_, wcgi := mod.ExportedFunctions()["wagi_wcgi"]
-					return &WasmItem{
-						CompiledModule: mod,
-						SupportWCGI:    wcgi,
-						Close:          cancel,
-					}, nil
-				})
-				mCache.Set(wasmKey, wasmGet)
-			}
-			wasm, err := wasmGet()
-			if err != nil {
-				mCache.Del(wasmKey)
-				return
-			}
-
-			// 强制以 CGI 模式运行
-			forceCGI := env["WASI_CGI"] == "true"
-			if forceCGI || !wasm.SupportWCGI {
-				envList := []string{}
-				for k, v := range env {
-					envList = append(envList, k+"="+v)
-				}
-
-				h := cgi.Handler{
-					Path:   script,
-					Args:   []string{"wcgi"},
-					Env:    envList,
-					Dir:    cwd,
-					Stderr: os.Stderr,
-
-					Runtime: rt,
-					WASM:    wasm.CompiledModule,
-				}
-				h.ServeHTTP(w, r)
-				return
+		shutdown := try.To1(setupTracing(ctx, args.trace, cmd.Root().Version))
+		defer shutdown(ctx)
+
+		params := wagi.FastCGIParams
+		switch args.protocol {
+		case "fcgi":
+		case "http":
+			params = wagi.EmptyParams
+		default:
+			try.To(fmt.Errorf("unknown protocol: %s", args.protocol))
+		}
+
+		sr := &wagi.StderrRouter{
+			Dir:        args.logDir,
+			MaxSize:    args.logMaxSize,
+			MaxBackups: args.logMaxBackups,
+		}
+
+		opts := try.To1(serverOptions())
+		opts = append(opts,
+			wagi.WithStderr(sr),
+			wagi.WithParams(params),
+			wagi.WithBudget(wagi.Budget{
+				MaxInstances: args.maxInstances,
+				MaxCGI:       args.maxCGI,
+				MaxMemory:    int64(args.maxMemory) << 20,
+			}),
+			wagi.WithCacheLimits(wagi.CacheLimits{
+				Modules:     args.maxModules,
+				ModuleBytes: int64(args.maxModuleSize) << 20,
+				Instances:   args.maxScripts,
+				Proxies:     args.maxCachedInstances,
+			}),
+			wagi.WithRecycle(wagi.Recycle{
+				MaxRequests: int64(args.recycleRequests),
+				MaxAge:      args.recycleAge,
+				MaxMemory:   int64(args.recycleMemory) << 20,
+			}),
+			wagi.WithHealthCheck(wagi.HealthCheck{
+				Interval: args.healthInterval,
+				Timeout:  args.healthTimeout,
+				Path:     args.healthPath,
+			}),
+		)
+		if args.responseCacheSize > 0 {
+			opts = append(opts, wagi.WithResponseCache(&wagi.ResponseCache{
+				MaxSize: int64(args.responseCacheSize) << 20,
+				Dir:     args.responseCacheDir,
+			}))
+		}
+		if len(args.compress) > 0 {
+			opts = append(opts, wagi.WithCompression(&wagi.Compression{
+				Encodings: args.compress,
+				MinSize:   args.compressMinSize,
+				Types:     args.compressTypes,
+			}))
+		}
+		if args.snapshot {
+			opts = append(opts, wagi.WithSnapshots())
+		}
+		if args.protocol == "http" && args.static {
+			opts = append(opts, wagi.WithStaticFiles())
+		}
+		h := try.To1(wagi.New(ctx, opts...))
+		defer h.Close(ctx)
+
+		if args.adminListen != "" {
+			if args.adminToken == "" {
+				try.To(errors.New("--admin-token is required by the admin api"))
 			}
+			al := try.To1(net.Listen("tcp", args.adminListen))
+			defer al.Close()
+			go http.Serve(al, h.AdminHandler(args.adminToken))
+			slog.Warn("admin api is running", "addr", al.Addr())
+		}
+
+		slog.Warn("server is running", "addr", l.Addr(), "protocol", args.protocol)
+		if args.protocol == "http" {
+			try.To(http.Serve(l, h))
+		}
+		try.To(fcgi.Serve(l, h))
+	},
+}
 
-			if proxyGet == nil {
-				proxyGet = sync.OnceValues(func() (_ *ProxyItem, err error) {
-					ctx := inst.ctx
-					ctx, cancel := context.WithCancel(ctx)
-					go func() {
-						<-ctx.Done()
-						proxyCache.Del(proxyKey)
-					}()
-
-					defer err0.Then(&err, nil, func() {
-						cancel()
-					})
-
-					stdio := &wcgi.Stdio{}
-					var (
-						stdin  io.Reader
-						stdout io.Writer
-					)
-					stdin, stdio.Writer = try.To2(os.Pipe())
-					stdio.Reader, stdout = try.To2(os.Pipe())
-
-					mc := wazero.NewModuleConfig()
-					mc = cgi.WithCommonConfig(mc)
-					fsc := wazero.NewFSConfig()
-					if cwd != "" {
-						fsc = fsc.WithDirMount(cwd, cwd)
-					}
-					if netRule != "" {
-						fsc = fsc.WithFSMount(fsnet.New(netRule), "/dev")
-					}
-					mc = mc.WithFSConfig(fsc)
-					env["WAGI_WCGI"] = "true"
-					for k, v := range env {
-						mc = mc.WithEnv(k, v)
-					}
-					if env["WASI_DEBUG"] == "true" {
-						mc = mc.WithStderr(os.Stderr)
-					}
-					mc = mc.WithStdin(stdin).WithStdout(stdout)
-
-					go func() {
-						defer cancel()
-						mc := mc.WithName("")
-						mod, err := rt.InstantiateModule(ctx, wasm.CompiledModule, mc)
-						if err != nil {
-							return
-						}
-						defer mod.Close(ctx)
-					}()
-
-					yc := yamux.DefaultConfig()
-					yc.KeepAliveInterval = 10 * time.Second
-					yc.StreamCloseTimeout = 5 * time.Second
-					yc.StreamOpenTimeout = 5 * time.Second
-					sess := try.To1(yamux.Client(stdio, yc))
-					sess.Ping()
-					go func() {
-						<-sess.CloseChan()
-						cancel()
-					}()
-					go func() {
-						<-ctx.Done()
-						sess.Close()
-					}()
-
-					endpoint := fmt.Sprintf("http://yamux.proxy/")
-					target := try.To1(url.Parse(endpoint))
-					handler := httputil.NewSingleHostReverseProxy(target)
-					handler.Transport = &http.Transport{
-						DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-							conn, err := sess.Open()
-							return conn, err
-						},
-					}
-					go http.Serve(sess, handler)
-
-					proxy := &ProxyItem{
-						Handler: handler,
-						Close:   cancel,
-					}
-					return proxy, nil
-				})
-				proxyCache.Set(proxyKey, proxyGet)
-			}
+// loadConfigArg 读取 --config 指定的配置文件, 未指定时返回空配置
+func loadConfigArg() (*Config, error) {
+	if args.config == "" {
+		return &Config{}, nil
+	}
+	return loadConfig(args.config)
+}
 
-			proxy, err := proxyGet()
-			if err != nil {
-				proxyCache.Del(proxyKey)
-				return
-			}
+// serverOptions 返回服务和 run, bench 子命令共用的选项: 编译缓存, 执行引擎以及 --config 中的路由, 站点和限流
+func serverOptions() ([]wagi.Option, error) {
+	cfg, err := loadConfigArg()
+	if err != nil {
+		return nil, err
+	}
+	engine, err := wagi.ParseEngine(args.engine)
+	if err != nil {
+		return nil, err
+	}
+	return []wagi.Option{
+		wagi.WithCacheDir(args.cacheDir),
+		wagi.WithEngine(engine),
+		wagi.WithResolver(newResolver(cfg)),
+		wagi.WithVirtualHosts(cfg.Hosts...),
+		wagi.WithPolicy(wagi.Policy{Limits: cfg.Limits}),
+	}, nil
+}
 
-			proxy.ServeHTTP(w, r)
-		})
+// ociCredentials 从环境变量 WAGI_OCI_AUTH_<registry> 读取 username:password 形式的账号,
+// registry 转为大写, 字母和数字以外的字符替换为 _, 如 ghcr.io 对应 WAGI_OCI_AUTH_GHCR_IO
+func ociCredentials(registry string) (username, password string) {
+	key := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, registry)
+	username, password, _ = strings.Cut(os.Getenv("WAGI_OCI_AUTH_"+key), ":")
+	return
+}
 
-		slog.Warn("server is running", "addr", l.Addr())
-		try.To(fcgi.Serve(l, h))
-	},
+// newResolver 支持运行 SCRIPT_FILENAME 为 http(s) 地址和 oci:// 引用的远程模块, 下载的模块缓存在 --cache-dir 中.
+// 配置了路由时按路由查找模块, 否则指定 --scripts-dir 时忽略 SCRIPT_FILENAME, 根据请求路径在该目录中查找模块
+func newResolver(cfg *Config) wagi.Resolver {
+	fetcher := &wagi.HTTPResolver{
+		CacheDir: filepath.Join(args.cacheDir, modulesDir),
+	}
+	oci := &wagi.OCIResolver{
+		CacheDir:    filepath.Join(args.cacheDir, modulesDir),
+		Interval:    args.ociInterval,
+		Credentials: ociCredentials,
+	}
+	if len(args.ociPlainHTTP) > 0 {
+		oci.PlainHTTP = func(registry string) bool {
+			return slices.Contains(args.ociPlainHTTP, registry)
+		}
+	}
+	var res wagi.Resolver = &wagi.SchemeResolver{
+		Schemes: map[string]wagi.Resolver{
+			"http":  fetcher,
+			"https": fetcher,
+			"oci":   oci,
+		},
+	}
+	switch {
+	case len(cfg.Routes) > 0:
+		res = &wagi.RouteTable{Routes: cfg.Routes, Next: res}
+	case args.scriptsDir != "":
+		res = wagi.DirResolver(args.scriptsDir)
+	}
+	return res
 }
 
 func getWASMTry(ctx context.Context, rt wazero.Runtime, script string) wazero.CompiledModule {
@@ -316,27 +263,41 @@ func init() {
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 
-	// rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.go-wagi.yaml)")
+	rootCmd.PersistentFlags().StringVar(&args.config, "config", "", "config file with routes")
+	rootCmd.PersistentFlags().StringVar(&args.cacheDir, "cache-dir", ".wazero", "wazero compilation cache dir")
+	rootCmd.PersistentFlags().DurationVar(&args.ociInterval, "oci-interval", 5*time.Minute, "interval to re-resolve tags of oci:// modules")
+	rootCmd.PersistentFlags().StringSliceVar(&args.ociPlainHTTP, "oci-plain-http", nil, "registries accessed over plain http, default localhost and 127.0.0.1")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	rootCmd.Flags().StringVar(&args.listen, "listen", "127.0.0.1:7071", "listen addr")
-}
-
-type InstanceItem struct {
-	WasmKey  string
-	ProxyKey string
-	ctx      context.Context
-	timer    *time.Timer
-}
-
-type WasmItem struct {
-	wazero.CompiledModule
-	SupportWCGI bool
-	Close       func()
-}
-
-type ProxyItem struct {
-	http.Handler
-	Close func()
+	rootCmd.Flags().StringVar(&args.protocol, "protocol", "fcgi", "serve fcgi behind a front proxy, or http directly")
+	rootCmd.Flags().BoolVar(&args.static, "static", true, "serve existing non-wasm files in DOCUMENT_ROOT before running modules in http protocol")
+	rootCmd.PersistentFlags().StringVar(&args.engine, "engine", "auto", "run modules with compiler, interpreter, or auto which interprets them until they are compiled in the background")
+	rootCmd.Flags().BoolVar(&args.snapshot, "snapshot", false, "start cgi instances from a memory snapshot taken after calling the wizer.initialize export of modules")
+	rootCmd.Flags().IntVar(&args.responseCacheSize, "response-cache-size", 0, "max size in megabytes of cached guest responses, 0 to disable the response cache")
+	rootCmd.Flags().StringVar(&args.responseCacheDir, "response-cache-dir", "", "store cached response bodies in this dir instead of memory")
+	rootCmd.Flags().IntVar(&args.maxInstances, "max-instances", 0, "max number of live wcgi instances across all scripts, 0 means unlimited")
+	rootCmd.Flags().IntVar(&args.maxCGI, "max-cgi", 0, "max number of concurrently running cgi instances, 0 means unlimited")
+	rootCmd.Flags().IntVar(&args.maxMemory, "max-memory", 0, "max total guest memory in megabytes, 0 means unlimited")
+	rootCmd.Flags().IntVar(&args.maxModules, "max-modules", 0, "max number of compiled modules kept in memory, least recently used ones are released first, 0 means unlimited")
+	rootCmd.Flags().IntVar(&args.maxModuleSize, "max-module-size", 0, "max total size in megabytes of wasm files of compiled modules kept in memory, 0 means unlimited")
+	rootCmd.Flags().IntVar(&args.maxScripts, "max-scripts", 0, "max number of loaded scripts, least recently used idle ones are released first, 0 means unlimited")
+	rootCmd.Flags().IntVar(&args.maxCachedInstances, "max-cached-instances", 0, "max number of cached wcgi instances, least recently used idle ones are closed first, 0 means unlimited")
+	rootCmd.Flags().DurationVar(&args.healthInterval, "health-interval", 0, "interval to health check wcgi instances, unhealthy ones are replaced, 0 to disable")
+	rootCmd.Flags().DurationVar(&args.healthTimeout, "health-timeout", 5*time.Second, "timeout of a wcgi health check")
+	rootCmd.Flags().StringVar(&args.healthPath, "health-path", "", "also GET this path of wcgi instances in health checks, e.g. /healthz")
+	rootCmd.Flags().IntVar(&args.recycleRequests, "recycle-requests", 0, "restart a wcgi instance after it served this many requests, 0 means never")
+	rootCmd.Flags().DurationVar(&args.recycleAge, "recycle-age", 0, "restart a wcgi instance after it ran this long, 0 means never")
+	rootCmd.Flags().IntVar(&args.recycleMemory, "recycle-memory", 0, "restart a wcgi instance when its guest memory exceeds this many megabytes, 0 means never")
+	rootCmd.Flags().StringSliceVar(&args.compress, "compress", nil, "compress responses with these encodings in preference order (br, zstd, gzip), empty to disable")
+	rootCmd.Flags().IntVar(&args.compressMinSize, "compress-min-size", 1024, "min size in bytes of a response to compress")
+	rootCmd.Flags().StringSliceVar(&args.compressTypes, "compress-types", nil, "content types to compress, supports text/*, default common text types")
+	rootCmd.Flags().StringVar(&args.scriptsDir, "scripts-dir", "", "find *.wasm modules in this dir by the request path instead of SCRIPT_FILENAME")
+	rootCmd.Flags().StringVar(&args.logDir, "log-dir", "", "write guest stderr to per-script log files in this dir, empty means the server log")
+	rootCmd.Flags().IntVar(&args.logMaxSize, "log-max-size", 10, "max size in megabytes of a guest log file before it gets rotated")
+	rootCmd.Flags().IntVar(&args.logMaxBackups, "log-max-backups", 3, "max number of rotated guest log files to retain")
+	rootCmd.Flags().StringVar(&args.trace, "trace", "", "export traces to stdout or otlp (configured by OTEL_EXPORTER_OTLP_* envs), empty to disable")
+	rootCmd.Flags().StringVar(&args.adminListen, "admin-listen", "", "listen addr of the admin http api, empty to disable")
+	rootCmd.Flags().StringVar(&args.adminToken, "admin-token", os.Getenv("WAGI_ADMIN_TOKEN"), "bearer token required by the admin api, default from env WAGI_ADMIN_TOKEN")
 }
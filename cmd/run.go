@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/shynome/err0"
+	"github.com/shynome/err0/try"
+	"github.com/shynome/go-wagi/cgi"
+	"github.com/shynome/go-wagi/wagi"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// requestArgs 描述一个模拟的请求, 由 run 和 bench 子命令共用
+type requestArgs struct {
+	method  string
+	path    string
+	host    string
+	root    string
+	headers []string
+	data    string
+	env     []string
+}
+
+func (a *requestArgs) addFlags(f *pflag.FlagSet) {
+	f.StringVarP(&a.method, "method", "X", "", "request method, default GET or POST if --data is set")
+	f.StringVar(&a.path, "path", "/", "request path with query")
+	f.StringVar(&a.host, "host", "localhost", "request host")
+	f.StringVar(&a.root, "root", "", "document root, default the dir of script")
+	f.StringArrayVarP(&a.headers, "header", "H", nil, "request header as 'Key: value'")
+	f.StringVarP(&a.data, "data", "d", "", "request body, @file to read from file")
+	f.StringArrayVarP(&a.env, "env", "e", nil, "extra fastcgi param as KEY=value, e.g. WASI_NET or WASI_CGI")
+}
+
+// build 返回和 fastcgi 一致的请求参数以及请求体
+func (a *requestArgs) build(script string) (env map[string]string, body []byte, err error) {
+	defer err0.Then(&err, nil, nil)
+
+	root := a.root
+	// 远程模块不需要转换为绝对路径
+	if !strings.Contains(script, "://") {
+		script = try.To1(filepath.Abs(script))
+		if root == "" {
+			root = filepath.Dir(script)
+		}
+	}
+	if root != "" {
+		root = try.To1(filepath.Abs(root))
+	}
+
+	if data := a.data; strings.HasPrefix(data, "@") {
+		body = try.To1(os.ReadFile(strings.TrimPrefix(data, "@")))
+	} else {
+		body = []byte(data)
+	}
+	method := a.method
+	if method == "" {
+		method = http.MethodGet
+		if len(body) > 0 {
+			method = http.MethodPost
+		}
+	}
+
+	u := try.To1(url.Parse(a.path))
+	env = map[string]string{
+		"SERVER_SOFTWARE":   "go-wagi",
+		"SERVER_PROTOCOL":   "HTTP/1.1",
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"REQUEST_METHOD":    method,
+		"REQUEST_URI":       u.RequestURI(),
+		"QUERY_STRING":      u.RawQuery,
+		"SCRIPT_NAME":       "/" + filepath.Base(script),
+		"PATH_INFO":         u.Path,
+		"SCRIPT_FILENAME":   script,
+		"DOCUMENT_ROOT":     root,
+		"HTTP_HOST":         a.host,
+		"SERVER_NAME":       a.host,
+		"REMOTE_ADDR":       "127.0.0.1",
+	}
+	if len(body) > 0 {
+		env["CONTENT_LENGTH"] = strconv.Itoa(len(body))
+	}
+	for _, h := range a.headers {
+		k, v, ok := strings.Cut(h, ":")
+		if !ok {
+			return nil, nil, fmt.Errorf("bad header: %q", h)
+		}
+		k = cgi.EnvKey(strings.TrimSpace(k))
+		v = strings.TrimSpace(v)
+		switch k {
+		case "CONTENT_TYPE", "CONTENT_LENGTH":
+			env[k] = v
+		default:
+			env["HTTP_"+k] = v
+		}
+	}
+	for _, kv := range a.env {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = v
+	}
+	return env, body, nil
+}
+
+// newRequest 根据 env 构造请求, env 会被 ServeParams 修改, 所以每次都复制一份
+func newRequest(ctx context.Context, env map[string]string, body []byte) (*http.Request, map[string]string, error) {
+	env = maps.Clone(env)
+	r, err := cgi.RequestFromMap(env)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return r.WithContext(ctx), env, nil
+}
+
+var runArgs requestArgs
+
+var runCmd = &cobra.Command{
+	Use:   "run <script>",
+	Short: "模拟一次请求执行脚本, 并输出 cgi 响应",
+	Example: `  go-wagi run ./example/index.php --path /hello1
+  go-wagi run ./index.php --method POST --path /hello1 -H 'X: y' --data @body.json
+  go-wagi run ./index.php -e WASI_NET=bypass=127.0.0.1 -e WASI_CGI=true`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, _args []string) (err error) {
+		defer err0.Then(&err, nil, nil)
+
+		env, body := try.To2(runArgs.build(_args[0]))
+
+		ctx := context.Background()
+		s := try.To1(wagi.New(ctx, try.To1(serverOptions())...))
+		defer s.Close(ctx)
+
+		r, env := try.To2(newRequest(ctx, env, body))
+		w := httptest.NewRecorder()
+		s.ServeParams(w, r, env)
+
+		resp := w.Result()
+		out := cmd.OutOrStdout()
+		fmt.Fprintf(out, "Status: %s\r\n", resp.Status)
+		try.To(resp.Header.Write(out))
+		fmt.Fprint(out, "\r\n")
+		_, err = io.Copy(out, resp.Body)
+		return
+	},
+}
+
+func init() {
+	runArgs.addFlags(runCmd.Flags())
+	rootCmd.AddCommand(runCmd)
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/shynome/err0"
 	"github.com/shynome/err0/try"
@@ -22,6 +23,13 @@ func init() {
 	http.HandleFunc("/hello2", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "hello2")
 	})
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	http.HandleFunc("/now", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		fmt.Fprintln(w, time.Now().UnixNano())
+	})
 	http.HandleFunc("/cat-index", func(w http.ResponseWriter, r *http.Request) {
 		var err error
 		defer err0.Then(&err, nil, func() {
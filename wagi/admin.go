@@ -0,0 +1,254 @@
+package wagi
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Duration 在 json 中输出为 [time.Duration.String] 的格式
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+type ScriptInfo struct {
+	Script   string    `json:"script"`
+	Instance string    `json:"instance,omitempty"`
+	WasmKey  string    `json:"wasm_key"`
+	ProxyKey string    `json:"proxy_key"`
+	LastUsed time.Time `json:"last_used"`
+	// KeepAlive 是空闲多久后释放, Pinned 为 true 时常驻
+	KeepAlive Duration    `json:"keepalive"`
+	Pinned    bool        `json:"pinned"`
+	Module    *ModuleInfo `json:"module,omitempty"`
+	WCGI      *WCGIInfo   `json:"wcgi,omitempty"`
+}
+
+type ModuleInfo struct {
+	Key         string    `json:"key"`
+	Size        int       `json:"size"`
+	Engine      Engine    `json:"engine"`
+	SupportWCGI bool      `json:"support_wcgi"`
+	CompiledAt  time.Time `json:"compiled_at"`
+	CompileTime Duration  `json:"compile_time"`
+	// 声明的内存页数限制
+	MemoryMin uint32  `json:"memory_min"`
+	MemoryMax *uint32 `json:"memory_max,omitempty"`
+}
+
+type WCGIInfo struct {
+	Key         string    `json:"key"`
+	State       string    `json:"state"`
+	Engine      Engine    `json:"engine"`
+	StartedAt   time.Time `json:"started_at"`
+	StartupTime Duration  `json:"startup_time"`
+	Requests    int64     `json:"requests"`
+	MemoryPages uint32    `json:"memory_pages"`
+	Healthy     bool      `json:"healthy"`
+	PingLatency Duration  `json:"ping_latency"`
+	Failures    int64     `json:"failures"` // 连续失败的健康检查次数
+}
+
+// Scripts 列出已加载的脚本
+func (s *Server) Scripts() []ScriptInfo {
+	list := []ScriptInfo{}
+	for _, inst := range s.instCache.Items() {
+		list = append(list, inst.info())
+	}
+	slices.SortFunc(list, func(a, b ScriptInfo) int {
+		return strings.Compare(a.Script, b.Script)
+	})
+	return list
+}
+
+// instances 返回脚本在各个站点和路由下的实例
+func (s *Server) instances(script string) []*InstanceItem {
+	var list []*InstanceItem
+	for _, inst := range s.instCache.Items() {
+		if inst.Script == script {
+			list = append(list, inst)
+		}
+	}
+	slices.SortFunc(list, func(a, b *InstanceItem) int {
+		return strings.Compare(a.Instance, b.Instance)
+	})
+	return list
+}
+
+// Script 返回脚本的状态, 脚本被多个站点或路由使用时返回第一个
+func (s *Server) Script(script string) (ScriptInfo, bool) {
+	list := s.instances(script)
+	if len(list) == 0 {
+		return ScriptInfo{}, false
+	}
+	return list[0].info(), true
+}
+
+// Evict 释放脚本的 wasm 模块和 wcgi 实例, 脚本未加载时返回 false
+func (s *Server) Evict(script string) bool {
+	list := s.instances(script)
+	for _, inst := range list {
+		inst.Close()
+	}
+	return len(list) > 0
+}
+
+// Restart 关闭脚本的 wcgi 实例, 下次请求时重新启动, 脚本未加载时返回 false
+func (s *Server) Restart(script string) bool {
+	list := s.instances(script)
+	for _, inst := range list {
+		if proxy := inst.proxy.Swap(nil); proxy != nil {
+			proxy.Close()
+		}
+	}
+	return len(list) > 0
+}
+
+// AdminHandler 提供运行时状态查看和实例管理, 请求需携带 `Authorization: Bearer <token>`, token 为空时拒绝所有请求
+//
+//	GET  /scripts                          列出已加载的脚本
+//	GET  /caches                           列出各个缓存的 key
+//	GET  /caches/stats                     各个缓存的容量和命中率
+//	POST /scripts/evict?script=            释放脚本的 wasm 模块和 wcgi 实例
+//	POST /scripts/restart?script=          关闭脚本的 wcgi 实例, 下次请求时重新启动
+//	GET  /budget                           全局预算的占用情况
+//	GET  /limits                           限流和并发限制的状态
+//	GET  /responses                        响应缓存的统计
+//	POST /responses/purge?script=&prefix=  删除缓存的响应, 参数为空时删除全部
+func (s *Server) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /scripts", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Scripts())
+	})
+	mux.HandleFunc("GET /caches", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string][]string{
+			"modules":   sortedKeys(s.mCache.Items()),
+			"proxies":   sortedKeys(s.proxyCache.Items()),
+			"instances": sortedKeys(s.instCache.Items()),
+		})
+	})
+	mux.HandleFunc("GET /caches/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.CacheStats())
+	})
+	mux.HandleFunc("POST /scripts/evict", func(w http.ResponseWriter, r *http.Request) {
+		if !s.Evict(r.URL.Query().Get("script")) {
+			http.Error(w, "script is not loaded", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /scripts/restart", func(w http.ResponseWriter, r *http.Request) {
+		if !s.Restart(r.URL.Query().Get("script")) {
+			http.Error(w, "script is not loaded", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /budget", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.BudgetUsage())
+	})
+	mux.HandleFunc("GET /limits", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Limits())
+	})
+	mux.HandleFunc("GET /responses", func(w http.ResponseWriter, r *http.Request) {
+		if s.respCache == nil {
+			http.Error(w, "response cache is disabled", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, s.respCache.Stats())
+	})
+	mux.HandleFunc("POST /responses/purge", func(w http.ResponseWriter, r *http.Request) {
+		if s.respCache == nil {
+			http.Error(w, "response cache is disabled", http.StatusNotFound)
+			return
+		}
+		q := r.URL.Query()
+		writeJSON(w, map[string]int{"purged": s.respCache.Purge(q.Get("script"), q.Get("prefix"))})
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (inst *InstanceItem) info() ScriptInfo {
+	inst.keys.Lock()
+	wasmKey, proxyKey := inst.WasmKey, inst.ProxyKey
+	inst.keys.Unlock()
+	info := ScriptInfo{
+		Script:   inst.Script,
+		Instance: inst.Instance,
+		WasmKey:  wasmKey,
+		ProxyKey: proxyKey,
+		LastUsed: inst.LastUsed(),
+
+		KeepAlive: Duration(inst.keepAlive.Load()),
+		Pinned:    inst.pinned.Load(),
+	}
+	if wasm := inst.wasm.Load(); wasm != nil {
+		m := &ModuleInfo{
+			Key:         wasm.Key,
+			Size:        wasm.Size,
+			Engine:      wasm.Engine,
+			SupportWCGI: wasm.SupportWCGI,
+			CompiledAt:  wasm.CompiledAt,
+			CompileTime: Duration(wasm.CompileTime),
+		}
+		for _, mem := range wasm.ExportedMemories() {
+			m.MemoryMin = mem.Min()
+			if max, ok := mem.Max(); ok {
+				m.MemoryMax = &max
+			}
+		}
+		info.Module = m
+	}
+	if proxy := inst.proxy.Load(); proxy != nil {
+		state := "running"
+		switch {
+		case proxy.Closed():
+			state = "closed"
+		case proxy.retired.Load():
+			state = "draining"
+		}
+		info.WCGI = &WCGIInfo{
+			Key:         proxy.Key,
+			State:       state,
+			Engine:      proxy.wasm.Engine,
+			StartedAt:   proxy.StartedAt,
+			StartupTime: Duration(proxy.StartupTime),
+			Requests:    proxy.requests.Load(),
+			MemoryPages: proxy.MemoryPages(),
+			Healthy:     proxy.health.failures.Load() == 0,
+			PingLatency: Duration(proxy.health.latency.Load()),
+			Failures:    proxy.health.failures.Load(),
+		}
+	}
+	return info
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,41 @@
+package wagi_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shynome/go-wagi/wagi"
+)
+
+func TestAdminToken(t *testing.T) {
+	ctx := context.Background()
+	s, err := wagi.New(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(ctx)
+
+	cases := []struct {
+		token, auth string
+		code        int
+	}{
+		{"secret", "Bearer secret", http.StatusOK},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+		{"", "Bearer ", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/scripts", nil)
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+		w := httptest.NewRecorder()
+		s.AdminHandler(c.token).ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("token %q, auth %q: %d, want %d", c.token, c.auth, w.Code, c.code)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package wagi
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// ErrBudgetExhausted 表示全局预算已用完且没有可以释放的空闲实例, 会响应 503
+var ErrBudgetExhausted = errors.New("budget exhausted")
+
+// Budget 是所有脚本共享的资源预算, 零值表示不限制
+//
+// 启动新的实例前检查预算, 不足时先关闭最近最少使用的空闲 wcgi 实例, 仍然不足时拒绝请求
+type Budget struct {
+	MaxInstances int   `yaml:"max_instances" json:"max_instances"` // 同时存在的 wcgi 实例数
+	MaxCGI       int   `yaml:"max_cgi" json:"max_cgi"`             // 同时运行的 cgi 实例数
+	MaxMemory    int64 `yaml:"max_memory" json:"max_memory"`       // guest 线性内存的总字节数
+}
+
+// BudgetUsage 是当前的资源占用
+type BudgetUsage struct {
+	Budget    Budget `json:"budget"`
+	Instances int    `json:"instances"`
+	CGI       int    `json:"cgi"`
+	Memory    int64  `json:"memory"`
+	Evicted   int64  `json:"evicted"`
+	Rejected  int64  `json:"rejected"`
+}
+
+type budgetState struct {
+	mux sync.Mutex
+	// 正在启动的 wcgi 实例和正在运行的 cgi 实例预留的内存, 启动后的 wcgi 实例按实际内存计算
+	starting int
+	cgi      int
+	reserved int64
+	evicted  int64
+	rejected int64
+	// 已启动的 wcgi 实例, 包括正在关闭和已被替换但还在处理请求的实例
+	live map[*ProxyItem]struct{}
+}
+
+// track 记录已启动的 wcgi 实例, 实例关闭后自动移除
+func (s *Server) track(proxy *ProxyItem) {
+	st := &s.budgetState
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	if st.live == nil {
+		st.live = map[*ProxyItem]struct{}{}
+	}
+	st.live[proxy] = struct{}{}
+	go func() {
+		<-proxy.ctx.Done()
+		st.mux.Lock()
+		defer st.mux.Unlock()
+		delete(st.live, proxy)
+	}()
+}
+
+// admit 为新的实例预留预算, cgi 为 false 时表示 wcgi 实例. 实例结束或启动完成后需要调用 release
+func (s *Server) admit(cgi bool, memory int64) (release func(), err error) {
+	b := s.budget
+	if b == (Budget{}) {
+		return func() {}, nil
+	}
+	st := &s.budgetState
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	for {
+		instances, used := s.liveInstances()
+		exhausted := ""
+		switch {
+		case cgi && b.MaxCGI > 0 && st.cgi >= b.MaxCGI:
+			// 关闭 wcgi 实例无法释放 cgi 的并发
+			st.rejected++
+			return nil, fmt.Errorf("%w: %d cgi instances are running", ErrBudgetExhausted, st.cgi)
+		case !cgi && b.MaxInstances > 0 && instances+st.starting >= b.MaxInstances:
+			exhausted = fmt.Sprintf("%d wcgi instances", instances+st.starting)
+		case b.MaxMemory > 0 && used+st.reserved+memory > b.MaxMemory:
+			exhausted = fmt.Sprintf("%d bytes of guest memory", used+st.reserved)
+		}
+		if exhausted == "" {
+			break
+		}
+		if !s.evictIdle() {
+			st.rejected++
+			return nil, fmt.Errorf("%w: %s", ErrBudgetExhausted, exhausted)
+		}
+		st.evicted++
+	}
+	if cgi {
+		st.cgi++
+	} else {
+		st.starting++
+	}
+	st.reserved += memory
+	return sync.OnceFunc(func() {
+		st.mux.Lock()
+		defer st.mux.Unlock()
+		if cgi {
+			st.cgi--
+		} else {
+			st.starting--
+		}
+		st.reserved -= memory
+	}), nil
+}
+
+// liveInstances 返回已启动的 wcgi 实例数和占用的内存, 调用时需要持有 budgetState.mux
+func (s *Server) liveInstances() (n int, memory int64) {
+	for proxy := range s.budgetState.live {
+		if !proxy.Closed() {
+			n++
+			memory += int64(proxy.MemoryPages()) * 65536
+		}
+	}
+	return
+}
+
+// evictIdle 关闭最近最少使用的空闲 wcgi 实例, 常驻的实例不会被关闭, 没有空闲实例时返回 false.
+// 调用时需要持有 budgetState.mux
+func (s *Server) evictIdle() bool {
+	var victim *ProxyItem
+	for proxy := range s.budgetState.live {
+		if proxy.Closed() || proxy.active.Load() > 0 || proxy.inst.pinned.Load() {
+			continue
+		}
+		if victim == nil || proxy.lastUsed.Load() < victim.lastUsed.Load() {
+			victim = proxy
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	s.logger.Info("evict idle wcgi instance", "script", victim.inst.Script)
+	s.dropProxy(victim)
+	victim.Close()
+	victim.inst.proxy.CompareAndSwap(victim, nil)
+	return true
+}
+
+// BudgetUsage 返回全局预算的占用情况
+func (s *Server) BudgetUsage() BudgetUsage {
+	st := &s.budgetState
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	instances, memory := s.liveInstances()
+	return BudgetUsage{
+		Budget:    s.budget,
+		Instances: instances + st.starting,
+		CGI:       st.cgi,
+		Memory:    memory + st.reserved,
+		Evicted:   st.evicted,
+		Rejected:  st.rejected,
+	}
+}
+
+// initialMemory 返回模块启动时的线性内存字节数
+func initialMemory(mod wazero.CompiledModule) int64 {
+	var pages uint32
+	for _, mem := range mod.ExportedMemories() {
+		pages = max(pages, mem.Min())
+	}
+	for _, mem := range mod.ImportedMemories() {
+		pages = max(pages, mem.Min())
+	}
+	return int64(pages) * 65536
+}
@@ -0,0 +1,161 @@
+package wagi_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shynome/go-wagi/wagi"
+	"github.com/tetratelabs/wazero"
+)
+
+func TestBudgetEvictsLeastRecentlyUsed(t *testing.T) {
+	s, _ := newGuestServer(t, wagi.WithBudget(wagi.Budget{MaxInstances: 2}))
+	get := func(name string) int {
+		return serve(s, "GET", "/id", map[string]string{"SCRIPT_FILENAME": name}).Code
+	}
+	for _, name := range []string{"a.wasm", "b.wasm", "a.wasm"} {
+		if code := get(name); code != http.StatusOK {
+			t.Fatalf("%s: %d", name, code)
+		}
+	}
+	// b 最近最少使用, 启动 c 时被关闭
+	if code := get("c.wasm"); code != http.StatusOK {
+		t.Fatalf("c.wasm: %d", code)
+	}
+	for name, running := range map[string]bool{"a.wasm": true, "b.wasm": false, "c.wasm": true} {
+		info, _ := s.Script(name)
+		if (info.WCGI != nil) != running {
+			t.Errorf("%s running %v, want %v", name, info.WCGI != nil, running)
+		}
+	}
+	if u := s.BudgetUsage(); u.Instances != 2 || u.Evicted != 1 || u.Rejected != 0 {
+		t.Errorf("usage: %+v", u)
+	}
+}
+
+func TestBudgetRejectsBusyInstances(t *testing.T) {
+	skipRace(t)
+	s, _ := newGuestServer(t, wagi.WithBudget(wagi.Budget{MaxInstances: 1}))
+	if code := serve(s, "GET", "/id", map[string]string{"SCRIPT_FILENAME": "a.wasm"}).Code; code != http.StatusOK {
+		t.Fatalf("warm up: %d", code)
+	}
+	done := make(chan int)
+	go func() {
+		done <- serve(s, "GET", "/sleep?d=500ms", map[string]string{"SCRIPT_FILENAME": "a.wasm"}).Code
+	}()
+	time.Sleep(100 * time.Millisecond)
+	// 正在处理请求的实例不会被关闭
+	w := serve(s, "GET", "/id", map[string]string{"SCRIPT_FILENAME": "b.wasm"})
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("b.wasm: %d %v", w.Code, w.Header())
+	}
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("a.wasm: %d", code)
+	}
+	// 请求结束后重试可以关闭空闲的实例
+	if code := serve(s, "GET", "/id", map[string]string{"SCRIPT_FILENAME": "b.wasm"}).Code; code != http.StatusOK {
+		t.Errorf("b.wasm retry: %d", code)
+	}
+	if u := s.BudgetUsage(); u.Rejected != 1 || u.Evicted != 1 {
+		t.Errorf("usage: %+v", u)
+	}
+}
+
+func TestBudgetCountsDrainingInstances(t *testing.T) {
+	skipRace(t)
+	s, _ := newGuestServer(t,
+		wagi.WithBudget(wagi.Budget{MaxInstances: 2}),
+		wagi.WithRecycle(wagi.Recycle{MaxRequests: 2}),
+	)
+	a := func() map[string]string {
+		return map[string]string{"SCRIPT_FILENAME": "a.wasm", "WASI_PINNED": "true"}
+	}
+	if code := serve(s, "GET", "/id", a()).Code; code != http.StatusOK {
+		t.Fatalf("warm up: %d", code)
+	}
+	done := make(chan int)
+	go func() { done <- serve(s, "GET", "/sleep?d=1s", a()).Code }()
+	time.Sleep(100 * time.Millisecond)
+	// 第二个请求后旧实例被替换, 但还在处理请求
+	if code := serve(s, "GET", "/id", a()).Code; code != http.StatusOK {
+		t.Fatalf("recycle: %d", code)
+	}
+	eventually(t, 5*time.Second, func() bool {
+		info, _ := s.Script("a.wasm")
+		return info.WCGI != nil && info.WCGI.Requests == 0
+	}, "a.wasm should be replaced")
+	if u := s.BudgetUsage(); u.Instances != 2 {
+		t.Errorf("draining instance should be counted: %+v", u)
+	}
+	if code := serve(s, "GET", "/id", map[string]string{"SCRIPT_FILENAME": "b.wasm"}).Code; code != http.StatusServiceUnavailable {
+		t.Errorf("b.wasm: %d, want 503", code)
+	}
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("draining request: %d", code)
+	}
+}
+
+func TestBudgetCGI(t *testing.T) {
+	s, _ := newGuestServer(t, wagi.WithBudget(wagi.Budget{MaxCGI: 1}))
+	params := func() map[string]string { return map[string]string{"WASI_CGI": "true"} }
+	done := make(chan int)
+	go func() { done <- serve(s, "GET", "/sleep?d=500ms", params()).Code }()
+	eventually(t, 30*time.Second, func() bool {
+		return s.BudgetUsage().CGI == 1
+	}, "cgi request should start")
+	if code := serve(s, "GET", "/id", params()).Code; code != http.StatusServiceUnavailable {
+		t.Errorf("second cgi request: %d, want 503", code)
+	}
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("first cgi request: %d", code)
+	}
+	if code := serve(s, "GET", "/id", params()).Code; code != http.StatusOK {
+		t.Errorf("cgi request after release: %d", code)
+	}
+	if u := s.BudgetUsage(); u.CGI != 0 || u.Rejected != 1 {
+		t.Errorf("usage: %+v", u)
+	}
+}
+
+func TestBudgetReservesMemory(t *testing.T) {
+	mem := guestMemory(t)
+	s, _ := newGuestServer(t, wagi.WithBudget(wagi.Budget{MaxMemory: mem * 3 / 2}))
+	params := func() map[string]string { return map[string]string{"WASI_CGI": "true"} }
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serve(s, "GET", "/sleep?d=500ms", params())
+	}()
+	eventually(t, 30*time.Second, func() bool {
+		return s.BudgetUsage().Memory == mem
+	}, "cgi request should reserve its initial memory")
+	if code := serve(s, "GET", "/id", params()).Code; code != http.StatusServiceUnavailable {
+		t.Errorf("second cgi request: %d, want 503", code)
+	}
+	wg.Wait()
+	if u := s.BudgetUsage(); u.Memory != 0 {
+		t.Errorf("memory should be released: %+v", u)
+	}
+}
+
+// guestMemory 返回 guest 启动时的线性内存字节数
+func guestMemory(t *testing.T) int64 {
+	ctx := context.Background()
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfigInterpreter())
+	defer rt.Close(ctx)
+	mod, err := rt.CompileModule(ctx, guestModule(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mod.ExportedMemories() {
+		return int64(m.Min()) * 65536
+	}
+	t.Fatal(errors.New("guest exports no memory"))
+	return 0
+}
@@ -0,0 +1,257 @@
+package wagi
+
+import (
+	"container/list"
+	"maps"
+	"sync"
+	"sync/atomic"
+)
+
+// Cache 是带容量限制的缓存, 超过 Capacity 或 MaxCost 时按最近最少使用淘汰, 零值表示不限制
+type Cache[T any] struct {
+	items map[string]T
+	mux   sync.RWMutex
+
+	Capacity int
+	MaxCost  int64
+	// OnEvict 在因容量淘汰时调用, 调用时不持有锁. Del 删除的不会调用
+	OnEvict func(key string, val T)
+	// Keep 返回 true 的条目不会被淘汰, 全部保留时允许超过容量. 调用时持有锁, 不能阻塞或访问缓存
+	Keep func(key string, val T) bool
+
+	lru    list.List // 最近使用的在前
+	elems  map[string]*list.Element
+	costs  map[string]int64
+	cost   int64
+	lruMux sync.Mutex
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+// CacheStats 是缓存的统计
+type CacheStats struct {
+	Items     int   `json:"items"`
+	Cost      int64 `json:"cost"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+// NewCache 创建一个缓存, 创建后可以设置 Capacity, MaxCost, OnEvict 和 Keep
+func NewCache[T any]() *Cache[T] {
+	return &Cache[T]{
+		items: map[string]T{},
+		elems: map[string]*list.Element{},
+		costs: map[string]int64{},
+	}
+}
+
+func (cache *Cache[T]) Get(key string) T {
+	cache.mux.RLock()
+	defer cache.mux.RUnlock()
+	val, ok := cache.items[key]
+	if !ok {
+		cache.misses.Add(1)
+		return val
+	}
+	cache.hits.Add(1)
+	cache.touch(key)
+	return val
+}
+
+func (cache *Cache[T]) Set(key string, val T) {
+	cache.mux.Lock()
+	cache.items[key] = val
+	cache.touch(key)
+	cache.mux.Unlock()
+	cache.evict()
+}
+
+// GetOrSet 返回 key 对应的值, 不存在时使用 create 创建
+func (cache *Cache[T]) GetOrSet(key string, create func() T) T {
+	cache.mux.Lock()
+	val, ok := cache.items[key]
+	if !ok {
+		val = create()
+		cache.items[key] = val
+	}
+	cache.touch(key)
+	cache.mux.Unlock()
+	if ok {
+		cache.hits.Add(1)
+		return val
+	}
+	cache.misses.Add(1)
+	cache.evict()
+	return val
+}
+
+// SetCost 设置 key 的开销, 如编译后模块的大小, 用于按 MaxCost 淘汰
+func (cache *Cache[T]) SetCost(key string, cost int64) {
+	cache.mux.RLock()
+	_, ok := cache.items[key]
+	if ok {
+		cache.lruMux.Lock()
+		cache.cost += cost - cache.costs[key]
+		cache.costs[key] = cost
+		cache.lruMux.Unlock()
+	}
+	cache.mux.RUnlock()
+	if ok {
+		cache.evict()
+	}
+}
+
+func (cache *Cache[T]) Del(key string) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	if _, ok := cache.items[key]; !ok {
+		return
+	}
+	delete(cache.items, key)
+	cache.forget(key)
+}
+
+// Items 返回缓存内容的快照
+func (cache *Cache[T]) Items() map[string]T {
+	cache.mux.RLock()
+	defer cache.mux.RUnlock()
+	return maps.Clone(cache.items)
+}
+
+func (cache *Cache[T]) Stats() CacheStats {
+	cache.mux.RLock()
+	n := len(cache.items)
+	cache.mux.RUnlock()
+	cache.lruMux.Lock()
+	cost := cache.cost
+	cache.lruMux.Unlock()
+	return CacheStats{
+		Items:     n,
+		Cost:      cost,
+		Hits:      cache.hits.Load(),
+		Misses:    cache.misses.Load(),
+		Evictions: cache.evictions.Load(),
+	}
+}
+
+// touch 将 key 移到最近使用, 调用时需持有 mux
+func (cache *Cache[T]) touch(key string) {
+	cache.lruMux.Lock()
+	defer cache.lruMux.Unlock()
+	if e, ok := cache.elems[key]; ok {
+		cache.lru.MoveToFront(e)
+		return
+	}
+	cache.elems[key] = cache.lru.PushFront(key)
+}
+
+// forget 删除 key 的使用记录, 调用时需持有 mux
+func (cache *Cache[T]) forget(key string) {
+	cache.lruMux.Lock()
+	defer cache.lruMux.Unlock()
+	if e, ok := cache.elems[key]; ok {
+		cache.lru.Remove(e)
+		delete(cache.elems, key)
+	}
+	cache.cost -= cache.costs[key]
+	delete(cache.costs, key)
+}
+
+func (cache *Cache[T]) over() bool {
+	cache.lruMux.Lock()
+	defer cache.lruMux.Unlock()
+	n := cache.lru.Len()
+	return n > 1 && ((cache.Capacity > 0 && n > cache.Capacity) || (cache.MaxCost > 0 && cache.cost > cache.MaxCost))
+}
+
+// evict 淘汰最近最少使用的条目直到满足容量限制, 最近使用的一个和 Keep 返回 true 的总会保留
+func (cache *Cache[T]) evict() {
+	if cache.Capacity <= 0 && cache.MaxCost <= 0 {
+		return
+	}
+	type evicted struct {
+		key string
+		val T
+	}
+	var victims []evicted
+	cache.mux.Lock()
+	cache.lruMux.Lock()
+	e := cache.lru.Back()
+	cache.lruMux.Unlock()
+	for e != nil && cache.over() {
+		cache.lruMux.Lock()
+		key, prev := e.Value.(string), e.Prev()
+		cache.lruMux.Unlock()
+		if prev == nil {
+			break
+		}
+		val := cache.items[key]
+		if cache.Keep == nil || !cache.Keep(key, val) {
+			delete(cache.items, key)
+			cache.forget(key)
+			victims = append(victims, evicted{key, val})
+		}
+		e = prev
+	}
+	cache.mux.Unlock()
+	for _, e := range victims {
+		cache.evictions.Add(1)
+		if cache.OnEvict != nil {
+			cache.OnEvict(e.key, e.val)
+		}
+	}
+}
+
+// setupCaches 按 CacheLimits 设置缓存容量, 被淘汰的模块和实例会被释放
+func (s *Server) setupCaches() {
+	l := s.cacheLimits
+	s.mCache.Capacity, s.mCache.MaxCost = l.Modules, l.ModuleBytes
+	s.mCache.OnEvict = func(key string, get func() (*WasmItem, error)) {
+		s.logger.Info("evict wasm module", "key", key)
+		// 模块可能还在编译, 不能阻塞调用方
+		go func() {
+			// 释放缓存持有的引用, 正在使用的请求和实例结束后才关闭模块
+			if wasm, err := get(); err == nil && wasm.retired.CompareAndSwap(false, true) {
+				wasm.release()
+			}
+		}()
+	}
+	s.proxyCache.Capacity = l.Proxies
+	s.proxyCache.Keep = func(key string, _ func() (*ProxyItem, error)) bool {
+		proxy, ok := s.proxies.Load(key)
+		return ok && proxy.(*ProxyItem).busy()
+	}
+	s.proxyCache.OnEvict = func(key string, get func() (*ProxyItem, error)) {
+		s.logger.Info("evict wcgi instance", "key", key)
+		go func() {
+			if proxy, err := get(); err == nil {
+				proxy.retired.Store(true)
+				proxy.Close()
+			}
+		}()
+	}
+	s.instCache.Capacity = l.Instances
+	s.instCache.Keep = func(_ string, inst *InstanceItem) bool {
+		if inst.pinned.Load() {
+			return true
+		}
+		proxy := inst.proxy.Load()
+		return proxy != nil && proxy.busy()
+	}
+	s.instCache.OnEvict = func(key string, inst *InstanceItem) {
+		s.logger.Info("evict script", "script", inst.Script)
+		inst.Close()
+	}
+}
+
+// CacheStats 返回各个缓存的统计
+func (s *Server) CacheStats() map[string]CacheStats {
+	return map[string]CacheStats{
+		"modules":   s.mCache.Stats(),
+		"proxies":   s.proxyCache.Stats(),
+		"instances": s.instCache.Stats(),
+	}
+}
@@ -0,0 +1,63 @@
+package wagi_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/shynome/go-wagi/wagi"
+)
+
+func TestCache(t *testing.T) {
+	c := wagi.NewCache[int]()
+	c.Capacity = 2
+	c.MaxCost = 100
+	var evicted []string
+	c.OnEvict = func(key string, val int) { evicted = append(evicted, key) }
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Get("a") // b 成为最近最少使用的
+	c.Set("c", 3)
+	if !slices.Equal(evicted, []string{"b"}) {
+		t.Fatalf("capacity eviction: %v", evicted)
+	}
+
+	c.SetCost("a", 60)
+	c.SetCost("c", 60)
+	if !slices.Equal(evicted, []string{"b", "a"}) {
+		t.Fatalf("cost eviction: %v", evicted)
+	}
+	c.Del("c")
+	if len(evicted) != 2 {
+		t.Errorf("Del should not call OnEvict")
+	}
+	c.Get("missing")
+
+	stats := c.Stats()
+	want := wagi.CacheStats{Items: 0, Cost: 0, Hits: 1, Misses: 1, Evictions: 2}
+	if stats != want {
+		t.Errorf("stats %+v, want %+v", stats, want)
+	}
+}
+
+func TestCacheKeep(t *testing.T) {
+	c := wagi.NewCache[int]()
+	c.Capacity = 2
+	var evicted []string
+	c.OnEvict = func(key string, val int) { evicted = append(evicted, key) }
+	c.Keep = func(key string, val int) bool { return val < 0 }
+
+	c.Set("pinned", -1)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	// 跳过保留的条目, 淘汰下一个最近最少使用的
+	if !slices.Equal(evicted, []string{"a"}) {
+		t.Fatalf("evicted %v, want [a]", evicted)
+	}
+	c.Set("b", -2)
+	c.Set("c", 3)
+	// 全部保留时允许超过容量
+	if !slices.Equal(evicted, []string{"a"}) || c.Stats().Items != 3 {
+		t.Errorf("evicted %v, items %d", evicted, c.Stats().Items)
+	}
+}
@@ -0,0 +1,243 @@
+package wagi
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression 根据 Accept-Encoding 压缩响应, cgi 和 wcgi 模式都适用
+//
+// 已经设置了 Content-Encoding, Cache-Control: no-transform, 以及 text/event-stream 的响应不会被压缩
+type Compression struct {
+	// Encodings 是支持的编码, 客户端权重相同时靠前的优先, 默认为 br, zstd, gzip
+	Encodings []string
+	// MinSize 是压缩的最小字节数, 默认为 1024
+	MinSize int
+	// Types 是压缩的 Content-Type, 支持 `text/*` 形式的通配符, 默认为常见的文本类型
+	Types []string
+}
+
+var defaultCompressTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+var compressEncoders = map[string]*sync.Pool{
+	"gzip": {New: func() any { return gzip.NewWriter(nil) }},
+	"br":   {New: func() any { return brotli.NewWriterLevel(nil, 5) }},
+	"zstd": {New: func() any {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return enc
+	}},
+}
+
+type resetWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+func (c *Compression) encodings() []string {
+	if len(c.Encodings) > 0 {
+		return c.Encodings
+	}
+	return []string{"br", "zstd", "gzip"}
+}
+
+func (c *Compression) minSize() int {
+	if c.MinSize > 0 {
+		return c.MinSize
+	}
+	return 1024
+}
+
+func (c *Compression) compressible(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	types := c.Types
+	if len(types) == 0 {
+		types = defaultCompressTypes
+	}
+	return slices.ContainsFunc(types, func(t string) bool {
+		if prefix, ok := strings.CutSuffix(t, "*"); ok {
+			return strings.HasPrefix(mt, prefix)
+		}
+		return mt == t
+	})
+}
+
+// negotiate 根据 Accept-Encoding 选择编码, 没有可用的编码时返回空
+func (c *Compression) negotiate(accept string) string {
+	best, bestQ := "", 0.0
+	q := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		v := 1.0
+		if qv, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			v, _ = strconv.ParseFloat(qv, 64)
+		}
+		if name != "" {
+			q[strings.ToLower(name)] = v
+		}
+	}
+	for _, enc := range c.encodings() {
+		if _, ok := compressEncoders[enc]; !ok {
+			continue
+		}
+		v, ok := q[enc]
+		if !ok {
+			v = q["*"]
+		}
+		if v > bestQ {
+			best, bestQ = enc, v
+		}
+	}
+	return best
+}
+
+func (c *Compression) wrap(w http.ResponseWriter, r *http.Request) *compressWriter {
+	return &compressWriter{
+		ResponseWriter: w,
+		c:              c,
+		enc:            c.negotiate(r.Header.Get("Accept-Encoding")),
+		head:           r.Method == http.MethodHead,
+	}
+}
+
+// compressWriter 先缓存 MinSize 字节再决定是否压缩, Flush 时按已缓存的大小决定
+type compressWriter struct {
+	http.ResponseWriter
+	c    *Compression
+	enc  string
+	head bool
+
+	status  int
+	decided bool
+	buf     []byte
+	cw      resetWriter
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.status != 0 {
+		return
+	}
+	// 直接发送 1xx, 按最终的响应决定是否压缩
+	if informational(code) {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+	h := w.Header()
+	if mt, _, _ := mime.ParseMediaType(h.Get("Content-Type")); mt == "text/event-stream" {
+		// 缓存到 MinSize 会阻塞事件流, 直接发送响应头
+		w.decide(false)
+		http.NewResponseController(w.ResponseWriter).Flush()
+		return
+	}
+	if w.c.compressible(h.Get("Content-Type")) {
+		h.Add("Vary", "Accept-Encoding")
+	} else {
+		w.decide(false)
+		return
+	}
+	switch {
+	case w.enc == "" || w.head,
+		code < 200, code == http.StatusNoContent, code == http.StatusNotModified, code == http.StatusPartialContent,
+		h.Get("Content-Encoding") != "", h.Get("Content-Range") != "",
+		strings.Contains(h.Get("Cache-Control"), "no-transform"):
+		w.decide(false)
+	default:
+		if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil {
+			w.decide(n >= w.c.minSize())
+		}
+	}
+}
+
+func (w *compressWriter) decide(compress bool) {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	if compress {
+		h := w.Header()
+		h.Set("Content-Encoding", w.enc)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		w.cw = compressEncoders[w.enc].Get().(resetWriter)
+		w.cw.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) > 0 {
+		w.write(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *compressWriter) write(b []byte) (int, error) {
+	if w.cw != nil {
+		return w.cw.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.decided {
+		return w.write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.c.minSize() {
+		w.decide(true)
+	}
+	return len(b), nil
+}
+
+func (w *compressWriter) Flush() {
+	if w.status == 0 {
+		return
+	}
+	w.decide(len(w.buf) >= w.c.minSize())
+	if f, ok := w.cw.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close 写入剩余的数据, 需要在响应结束后调用
+func (w *compressWriter) Close() error {
+	if w.status == 0 {
+		return nil
+	}
+	w.decide(len(w.buf) >= w.c.minSize())
+	if w.cw == nil {
+		return nil
+	}
+	err := w.cw.Close()
+	w.cw.Reset(nil)
+	compressEncoders[w.enc].Put(w.cw)
+	w.cw = nil
+	return err
+}
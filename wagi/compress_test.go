@@ -0,0 +1,148 @@
+package wagi_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/shynome/go-wagi/wagi"
+)
+
+func TestCompression(t *testing.T) {
+	dir := t.TempDir()
+	large := strings.Repeat("body{color:red}\n", 200)
+	files := map[string]string{
+		"large.css": large,
+		"small.css": "body{}",
+		"image.png": strings.Repeat("\x89PNG", 1000),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res := wagi.ResolverFunc(func(r *http.Request, params map[string]string) (*wagi.Script, error) {
+		return nil, fmt.Errorf("%w: module", wagi.ErrScriptNotFound)
+	})
+	ctx := context.Background()
+	s, err := wagi.New(ctx,
+		wagi.WithResolver(res),
+		wagi.WithParams(wagi.ScriptParams(filepath.Join(dir, "index.wasm"), dir)),
+		wagi.WithStaticFiles(),
+		wagi.WithCompression(&wagi.Compression{Encodings: []string{"zstd", "gzip"}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(ctx)
+
+	serve := func(p string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", p, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("/large.css", "Accept-Encoding", "gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" || !strings.HasPrefix(w.Header().Get("ETag"), "W/") {
+		t.Fatalf("gzip: %v", w.Header())
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(gr); string(b) != large {
+		t.Errorf("gzip body mismatch")
+	}
+	if w := serve("/large.css", "Accept-Encoding", "gzip", "If-None-Match", w.Header().Get("ETag")); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: %d", w.Code)
+	}
+
+	// 权重相同时使用服务端的顺序
+	w = serve("/large.css", "Accept-Encoding", "gzip, zstd, br")
+	if w.Header().Get("Content-Encoding") != "zstd" {
+		t.Fatalf("zstd: %v", w.Header())
+	}
+	zr, err := zstd.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(zr); string(b) != large {
+		t.Errorf("zstd body mismatch")
+	}
+
+	cases := []struct {
+		path   string
+		header []string
+	}{
+		{"/large.css", []string{"Accept-Encoding", "gzip;q=0, br"}},
+		{"/large.css", []string{"Accept-Encoding", "gzip", "Range", "bytes=0-3"}},
+		{"/small.css", []string{"Accept-Encoding", "gzip"}},
+		{"/image.png", []string{"Accept-Encoding", "gzip"}},
+		{"/missing", []string{"Accept-Encoding", "gzip"}},
+	}
+	for _, c := range cases {
+		w := serve(c.path, c.header...)
+		if enc := w.Header().Get("Content-Encoding"); enc != "" {
+			t.Errorf("%s %v should not be compressed: %s", c.path, c.header, enc)
+		}
+		if want := files[strings.TrimPrefix(c.path, "/")]; want != "" && !strings.HasPrefix(want, w.Body.String()) {
+			t.Errorf("%s %v: body mismatch", c.path, c.header)
+		}
+	}
+}
+
+// hintsRecorder 单独记录 1xx 响应, httptest.ResponseRecorder 会把第一个状态码当作最终的状态码
+type hintsRecorder struct {
+	*httptest.ResponseRecorder
+	hints []int
+}
+
+func (w *hintsRecorder) WriteHeader(code int) {
+	if code >= 100 && code < 200 {
+		w.hints = append(w.hints, code)
+		return
+	}
+	w.ResponseRecorder.WriteHeader(code)
+}
+
+func TestCompressionGuest(t *testing.T) {
+	s, _ := newGuestServer(t, wagi.WithCompression(&wagi.Compression{Encodings: []string{"gzip"}}))
+	serve := func(url string) *hintsRecorder {
+		w := &hintsRecorder{ResponseRecorder: httptest.NewRecorder()}
+		r := httptest.NewRequest("GET", url, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		s.ServeParams(w, r, map[string]string{})
+		return w
+	}
+
+	// 103 Early Hints 直接发送, 最终的响应仍然压缩
+	w := serve("/early")
+	if len(w.hints) != 1 || w.hints[0] != http.StatusEarlyHints || w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("early hints: %v %d %v", w.hints, w.Code, w.Header())
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(gr); len(b) == 0 {
+		t.Errorf("empty body")
+	}
+
+	// 事件流不压缩, 并且立即发送响应头
+	w = serve("/cache/?h=Content-Type:text/event-stream&pad=2000")
+	if w.Header().Get("Content-Encoding") != "" || !w.Flushed || w.Body.Len() < 2000 {
+		t.Errorf("event stream: flushed %v, %v", w.Flushed, w.Header())
+	}
+}
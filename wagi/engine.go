@@ -0,0 +1,190 @@
+package wagi
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Engine 是执行模块的方式
+type Engine string
+
+const (
+	// EngineCompiler 将模块编译为机器码, 运行快但编译大模块需要较长时间
+	EngineCompiler Engine = "compiler"
+	// EngineInterpreter 解释执行模块, 几乎不需要编译但运行慢
+	EngineInterpreter Engine = "interpreter"
+	// EngineAuto 在后台编译, 没有及时完成时先解释执行, 编译完成后新的实例使用编译后的模块
+	EngineAuto Engine = "auto"
+)
+
+// ParseEngine 解析 compiler, interpreter 或 auto
+func ParseEngine(s string) (Engine, error) {
+	switch e := Engine(s); e {
+	case EngineCompiler, EngineInterpreter, EngineAuto:
+		return e, nil
+	}
+	return "", fmt.Errorf("unknown engine %q, want compiler, interpreter or auto", s)
+}
+
+// engineOf 返回脚本使用的引擎, 可以通过 WASI_ENGINE 参数覆盖
+func (s *Server) engineOf(script string, params map[string]string) Engine {
+	v := params["WASI_ENGINE"]
+	if v == "" {
+		return s.engine
+	}
+	e, err := ParseEngine(v)
+	if err != nil {
+		s.logger.Warn("ignore WASI_ENGINE", "script", script, "err", err)
+		return s.engine
+	}
+	return e
+}
+
+// compileWasm 使用 engine 对应的 runtime 编译模块, 模块在 ctx 结束或调用 Close 时释放
+func (s *Server) compileWasm(ctx context.Context, engine Engine, key, script string, binary []byte, size int, globals []string) (*WasmItem, error) {
+	rt := s.rt
+	if engine == EngineInterpreter {
+		irt, err := s.irt()
+		if err != nil {
+			return nil, err
+		}
+		rt = irt
+	}
+	ctx2, timeout := context.WithTimeout(ctx, 3*time.Minute)
+	defer timeout()
+	start := time.Now()
+	mod, err := rt.CompileModule(ctx2, binary)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	item := &WasmItem{
+		CompiledModule: mod,
+		Key:            key,
+		Size:           size,
+		Engine:         engine,
+		SupportWCGI:    SupportWCGI(mod),
+		CompiledAt:     start,
+		CompileTime:    time.Since(start),
+		Close:          cancel,
+		ctx:            ctx,
+		runtime:        rt,
+	}
+	item.refs.Store(1)
+	s.guests.Add(1)
+	go func() {
+		defer s.guests.Done()
+		<-ctx.Done()
+		// 被替换或淘汰时缓存中可能已经是新的模块
+		if !item.retired.Load() {
+			s.mCache.Del(key)
+		}
+		mod.Close(ctx)
+	}()
+	if globals != nil {
+		item.snapshot = sync.OnceValues(func() (*snapshot, error) {
+			snap, err := takeSnapshot(ctx, rt, mod, globals)
+			if err != nil {
+				s.logger.Warn("take snapshot failed", "script", script, "err", err)
+				return nil, err
+			}
+			s.logger.Info("take snapshot", "script", script, "pages", snap.pages, "took", snap.took)
+			return snap, nil
+		})
+	}
+	return item, nil
+}
+
+// autoCompileWait 是 auto 模式下先等待编译的时间, 编译缓存命中时通常可以直接使用编译后的模块
+const autoCompileWait = 500 * time.Millisecond
+
+type compileResult struct {
+	wasm *WasmItem
+	err  error
+}
+
+// compileAuto 在后台编译模块, 没有及时完成时先解释执行, 编译完成后再替换为编译后的模块
+func (s *Server) compileAuto(ctx context.Context, key, script string, binary []byte, size int, globals []string) (*WasmItem, error) {
+	compiled := make(chan compileResult, 1)
+	go func() {
+		wasm, err := s.compileWasm(ctx, EngineCompiler, key, script, binary, size, globals)
+		compiled <- compileResult{wasm, err}
+	}()
+	timer := time.NewTimer(autoCompileWait)
+	defer timer.Stop()
+	select {
+	case res := <-compiled:
+		return res.wasm, res.err
+	case <-timer.C:
+	}
+	interp, err := s.compileWasm(ctx, EngineInterpreter, key, script, binary, size, globals)
+	if err != nil {
+		go func() {
+			if res := <-compiled; res.err == nil {
+				res.wasm.Close()
+			}
+		}()
+		return nil, err
+	}
+	go s.swapCompiled(ctx, interp, script, compiled)
+	return interp, nil
+}
+
+// swapCompiled 等待后台编译完成, 替换缓存中解释执行的模块, 并重启解释执行的 wcgi 实例
+func (s *Server) swapCompiled(ctx context.Context, interp *WasmItem, script string, compiled <-chan compileResult) {
+	res := <-compiled
+	if res.err != nil {
+		if ctx.Err() == nil {
+			s.logger.Warn("compile module in background failed", "script", script, "err", res.err)
+		}
+		return
+	}
+	item := res.wasm
+	// 解释执行的模块已被释放, 如脚本已更新
+	if interp.ctx.Err() != nil {
+		item.Close()
+		return
+	}
+	// 已被淘汰时缓存持有的引用也已释放
+	if !interp.retired.CompareAndSwap(false, true) {
+		item.Close()
+		return
+	}
+	s.mCache.Set(interp.Key, func() (*WasmItem, error) { return item, nil })
+	s.mCache.SetCost(interp.Key, int64(item.Size))
+	s.logger.Info("swap to compiled module", "script", script, "compile_time", item.CompileTime)
+	// 下一个请求会使用编译后的模块启动新的实例
+	for _, inst := range s.instCache.Items() {
+		if proxy := inst.proxy.Load(); proxy != nil && proxy.wasm == interp && s.dropProxy(proxy) {
+			go s.drain(proxy)
+		}
+	}
+	go func() {
+		<-interp.ctx.Done()
+		s.logger.Info("release interpreted module", "script", script)
+	}()
+	// 释放缓存持有的引用, 最后一个使用者结束后关闭解释执行的模块
+	interp.release()
+}
+
+// acquire 增加模块的引用, 模块已因替换而释放时返回 false. 使用完后需要调用 release
+func (w *WasmItem) acquire() bool {
+	for {
+		n := w.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if w.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// release 减少模块的引用, 没有引用时关闭模块
+func (w *WasmItem) release() {
+	if w.refs.Add(-1) == 0 {
+		w.Close()
+	}
+}
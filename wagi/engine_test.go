@@ -0,0 +1,108 @@
+package wagi_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shynome/go-wagi/wagi"
+)
+
+func TestParseEngine(t *testing.T) {
+	for _, s := range []string{"compiler", "interpreter", "auto"} {
+		if e, err := wagi.ParseEngine(s); err != nil || string(e) != s {
+			t.Errorf("%s: %q %v", s, e, err)
+		}
+	}
+	for _, s := range []string{"", "jit", "Compiler"} {
+		if _, err := wagi.ParseEngine(s); err == nil {
+			t.Errorf("%q should be rejected", s)
+		}
+	}
+}
+
+func TestEngineOverride(t *testing.T) {
+	s, log := newGuestServer(t)
+	cases := []struct {
+		script, engine string
+		want           wagi.Engine
+	}{
+		{"default.wasm", "", wagi.EngineCompiler},
+		{"interpreter.wasm", "interpreter", wagi.EngineInterpreter},
+		{"invalid.wasm", "jit", wagi.EngineCompiler},
+	}
+	for _, c := range cases {
+		w := serve(s, "GET", "/id", map[string]string{"SCRIPT_FILENAME": c.script, "WASI_ENGINE": c.engine})
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", c.script, w.Code, w.Body)
+		}
+		info, _ := s.Script(c.script)
+		if info.Module == nil || info.Module.Engine != c.want || info.WCGI.Engine != c.want {
+			t.Errorf("%s: %+v, want %s", c.script, info.Module, c.want)
+		}
+		// 与服务默认的引擎不同时使用单独的模块缓存
+		if got := strings.HasSuffix(info.WasmKey, "@"+string(c.want)); got != (c.want != wagi.EngineCompiler) {
+			t.Errorf("%s: wasm key %q", c.script, info.WasmKey)
+		}
+	}
+	if log.Count("ignore WASI_ENGINE") == 0 {
+		t.Errorf("invalid engine should be logged")
+	}
+}
+
+func TestEngineAuto(t *testing.T) {
+	skipRace(t)
+	s, _ := newGuestServer(t, wagi.WithEngine(wagi.EngineAuto))
+	// 编译缓存命中时直接使用编译后的模块, 否则先解释执行, 编译完成后替换
+	eventually(t, time.Minute, func() bool {
+		if w := do(s, "GET", "/id"); w.Code != http.StatusOK {
+			t.Fatalf("%d %s", w.Code, w.Body)
+		}
+		info, _ := s.Script("guest.wasm")
+		return info.Module.Engine == wagi.EngineCompiler && info.WCGI.Engine == wagi.EngineCompiler
+	}, "should switch to the compiled module")
+}
+
+func TestEngineAutoSwap(t *testing.T) {
+	skipRace(t)
+	// 没有编译缓存时编译超过 autoCompileWait, 先解释执行
+	s, log := newGuestServer(t, wagi.WithEngine(wagi.EngineAuto), wagi.WithCacheDir(t.TempDir()))
+	if w := do(s, "GET", "/id"); w.Code != http.StatusOK {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	if info, _ := s.Script("guest.wasm"); info.Module.Engine != wagi.EngineInterpreter {
+		t.Fatalf("should start interpreted: %+v", info.Module)
+	}
+
+	// 替换期间一直有请求, POST 请求失败时不会重试
+	stop := make(chan struct{})
+	failed := make(chan int, 1)
+	go func() {
+		defer close(failed)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if w := do(s, "POST", "/sleep?d=200ms"); w.Code != http.StatusOK {
+				failed <- w.Code
+				return
+			}
+		}
+	}()
+	eventually(t, time.Minute, func() bool {
+		return log.Count("swap to compiled module") == 1
+	}, "should swap to the compiled module")
+	eventually(t, 5*time.Second, func() bool {
+		return log.Count("release interpreted module") == 1
+	}, "interpreted module should be released after its users")
+	close(stop)
+	if code, ok := <-failed; ok {
+		t.Errorf("request during swap: %d", code)
+	}
+	if info, _ := s.Script("guest.wasm"); info.Module.Engine != wagi.EngineCompiler || info.WCGI.Engine != wagi.EngineCompiler {
+		t.Errorf("should use the compiled module: %+v %+v", info.Module, info.WCGI)
+	}
+}
@@ -0,0 +1,126 @@
+package wagi_test
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shynome/go-wagi/wagi"
+)
+
+// buildGuest 编译 testdata/guest, 编译缓存在多次测试间共用
+var buildGuest = sync.OnceValues(func() ([]byte, error) {
+	out := filepath.Join(os.TempDir(), "go-wagi-test-guest.wasm")
+	cmd := exec.Command("go", "build", "-o", out, "./testdata/guest")
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+	if b, err := cmd.CombinedOutput(); err != nil {
+		return nil, &exec.ExitError{Stderr: b}
+	}
+	return os.ReadFile(out)
+})
+
+func guestModule(t *testing.T) []byte {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("building the guest module is slow")
+	}
+	bin, err := buildGuest()
+	if err != nil {
+		t.Fatalf("build guest: %v %s", err, err.(*exec.ExitError).Stderr)
+	}
+	return bin
+}
+
+// skipRace 跳过依赖时序的测试, race 检测下编译和运行都慢得多
+func skipRace(t *testing.T) {
+	t.Helper()
+	if raceEnabled {
+		t.Skip("timing sensitive under the race detector")
+	}
+}
+
+// guestResolver 对所有请求返回 testdata/guest, 可以通过 SCRIPT_FILENAME 区分不同的脚本
+func guestResolver(t *testing.T) wagi.Resolver {
+	bin := guestModule(t)
+	return wagi.ResolverFunc(func(r *http.Request, params map[string]string) (*wagi.Script, error) {
+		name := params["SCRIPT_FILENAME"]
+		if name == "" {
+			name = "guest.wasm"
+		}
+		return &wagi.Script{
+			Name: name,
+			Key:  name,
+			Load: func(ctx context.Context) ([]byte, error) { return bin, nil },
+		}, nil
+	})
+}
+
+// guestLog 记录服务和 guest 的日志
+type guestLog struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *guestLog) Write(p []byte) (int, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *guestLog) Count(s string) int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return strings.Count(l.buf.String(), s)
+}
+
+// newGuestServer 创建运行 testdata/guest 的服务, opts 可以覆盖默认的选项
+func newGuestServer(t *testing.T, opts ...wagi.Option) (*wagi.Server, *guestLog) {
+	t.Helper()
+	log := &guestLog{}
+	opts = append([]wagi.Option{
+		wagi.WithResolver(guestResolver(t)),
+		wagi.WithParams(wagi.EmptyParams),
+		wagi.WithEngine(wagi.EngineCompiler),
+		wagi.WithCacheDir(filepath.Join(os.TempDir(), "go-wagi-test-wazero")),
+		wagi.WithLogger(slog.New(slog.NewTextHandler(log, nil))),
+	}, opts...)
+	ctx := context.Background()
+	s, err := wagi.New(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close(ctx) })
+	return s, log
+}
+
+func do(h http.Handler, method, url string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+	return w
+}
+
+// serve 使用指定的 fastcgi 参数处理请求
+func serve(s *wagi.Server, method, url string, params map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeParams(w, httptest.NewRequest(method, url, nil), params)
+	return w
+}
+
+// eventually 等待 cond 成立
+func eventually(t *testing.T, timeout time.Duration, cond func() bool, msg string) {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+	}
+}
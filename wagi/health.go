@@ -0,0 +1,103 @@
+package wagi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// HealthCheck 定时检查 wcgi 实例, Interval 为 0 时不检查
+//
+// 每次检查先通过 yamux ping 实例, 设置了 Path 时再请求 guest 的该路径, 响应码不小于 400 视为失败.
+// 脚本可以通过 WASI_HEALTH_PATH 覆盖 Path
+type HealthCheck struct {
+	Interval time.Duration
+	Timeout  time.Duration // 单次检查的超时, 默认为 5 秒
+	Path     string
+	Failures int // 连续失败多少次后关闭实例, 默认为 3
+}
+
+type healthState struct {
+	latency  atomic.Int64 // 最近一次 ping 的耗时
+	failures atomic.Int64
+}
+
+// watchHealth 定时检查实例直到实例关闭, 连续失败时关闭实例
+func (s *Server) watchHealth(ctx context.Context, script string, proxy *ProxyItem, sess *yamux.Session, client *http.Client, path string) {
+	h := s.health
+	if h.Timeout <= 0 {
+		h.Timeout = 5 * time.Second
+	}
+	if h.Failures <= 0 {
+		h.Failures = 3
+	}
+	if path == "" {
+		path = h.Path
+	}
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := s.checkHealth(ctx, h.Timeout, proxy, sess, client, path)
+		if err == nil {
+			proxy.health.failures.Store(0)
+			continue
+		}
+		n := proxy.health.failures.Add(1)
+		s.logger.Warn("wcgi health check failed", "script", script, "err", err, "failures", n)
+		if n >= int64(h.Failures) {
+			s.logger.Warn("close unhealthy wcgi instance", "script", script)
+			s.dropProxy(proxy)
+			proxy.Close()
+			return
+		}
+	}
+}
+
+func (s *Server) checkHealth(ctx context.Context, timeout time.Duration, proxy *ProxyItem, sess *yamux.Session, client *http.Client, path string) error {
+	// yamux 的 Ping 没有超时, 卡住的实例会一直不返回
+	ping := make(chan error, 1)
+	go func() {
+		rtt, err := sess.Ping()
+		if err == nil {
+			proxy.health.latency.Store(int64(rtt))
+		}
+		ping <- err
+	}()
+	select {
+	case err := <-ping:
+		if err != nil {
+			return fmt.Errorf("ping: %w", err)
+		}
+	case <-time.After(timeout):
+		return fmt.Errorf("ping: timeout after %s", timeout)
+	}
+	if path == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://yamux.proxy"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return nil
+}
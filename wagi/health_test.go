@@ -0,0 +1,75 @@
+package wagi_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shynome/go-wagi/wagi"
+)
+
+var fastHealthCheck = wagi.HealthCheck{Interval: 100 * time.Millisecond, Timeout: 100 * time.Millisecond, Failures: 2}
+
+func TestHealthCheckPing(t *testing.T) {
+	s, log := newGuestServer(t, wagi.WithHealthCheck(fastHealthCheck))
+	id := do(s, "GET", "/spin").Body.String()
+	eventually(t, 5*time.Second, func() bool {
+		return log.Count("close unhealthy wcgi instance") == 1
+	}, "spinning instance should be closed")
+	if n := log.Count("wcgi health check failed"); n != 2 {
+		t.Errorf("closed after %d failures, want 2", n)
+	}
+	if w := do(s, "GET", "/id"); w.Code != http.StatusOK || w.Body.String() == id {
+		t.Errorf("should start a new instance: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestHealthCheckPath(t *testing.T) {
+	s, log := newGuestServer(t, wagi.WithHealthCheck(fastHealthCheck))
+	params := func() map[string]string { return map[string]string{"WASI_HEALTH_PATH": "/healthz"} }
+	id := serve(s, "GET", "/id", params()).Body.String()
+	time.Sleep(300 * time.Millisecond)
+	if log.Count("wcgi health check failed") != 0 {
+		t.Fatalf("healthy instance failed the check")
+	}
+	if info, _ := s.Script("guest.wasm"); info.WCGI == nil || !info.WCGI.Healthy {
+		t.Errorf("should be healthy: %+v", info.WCGI)
+	}
+
+	serve(s, "GET", "/sick", params())
+	eventually(t, 5*time.Second, func() bool {
+		return log.Count("close unhealthy wcgi instance") == 1
+	}, "sick instance should be closed")
+	if log.Count("500 Internal Server Error") == 0 {
+		t.Errorf("should log the probe status")
+	}
+	if w := serve(s, "GET", "/id", params()); w.Body.String() == id {
+		t.Errorf("should start a new instance")
+	}
+}
+
+func TestRetryOnFreshInstance(t *testing.T) {
+	s, log := newGuestServer(t)
+	id := do(s, "GET", "/id").Body.String()
+	// 实例在处理请求时退出, GET 请求在新的实例上重试
+	w := do(s, "GET", "/exit?id="+id)
+	if w.Code != http.StatusOK || w.Body.String() == id || w.Body.String() == "" {
+		t.Fatalf("GET: %d %q", w.Code, w.Body)
+	}
+	if n := log.Count("guest started"); n != 2 {
+		t.Errorf("%d instances started, want 2", n)
+	}
+
+	// 有请求体的 POST 请求不重试
+	id = w.Body.String()
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/exit?id="+id, strings.NewReader("body")))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("POST: %d %q, want 502", w.Code, w.Body)
+	}
+	if n := log.Count("guest started"); n != 2 {
+		t.Errorf("POST should not be retried, %d instances started", n)
+	}
+}
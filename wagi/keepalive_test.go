@@ -0,0 +1,83 @@
+package wagi_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/shynome/go-wagi/wagi"
+)
+
+func TestKeepAlive(t *testing.T) {
+	skipRace(t)
+	s, _ := newGuestServer(t)
+	pinned := map[string]string{"SCRIPT_FILENAME": "pinned.wasm", "WASI_KEEPALIVE": "500ms", "WASI_PINNED": "true"}
+	if w := serve(s, "GET", "/id", pinned); w.Code != http.StatusOK {
+		t.Fatalf("pinned: %d %s", w.Code, w.Body)
+	}
+	short := map[string]string{"SCRIPT_FILENAME": "short.wasm", "WASI_KEEPALIVE": "500ms"}
+	if w := serve(s, "GET", "/id", short); w.Code != http.StatusOK {
+		t.Fatalf("short: %d %s", w.Code, w.Body)
+	}
+	if info, _ := s.Script("short.wasm"); time.Duration(info.KeepAlive) != 500*time.Millisecond || info.Pinned {
+		t.Errorf("short: keepalive %s pinned %v", time.Duration(info.KeepAlive), info.Pinned)
+	}
+
+	eventually(t, 3*time.Second, func() bool {
+		_, ok := s.Script("short.wasm")
+		return !ok
+	}, "short.wasm should be released after 500ms")
+	time.Sleep(500 * time.Millisecond)
+	info, ok := s.Script("pinned.wasm")
+	if !ok || !info.Pinned || info.WCGI == nil || info.WCGI.State != "running" {
+		t.Errorf("pinned.wasm should stay: %+v", info)
+	}
+}
+
+func TestPinnedNotEvicted(t *testing.T) {
+	s, _ := newGuestServer(t, wagi.WithBudget(wagi.Budget{MaxInstances: 1}))
+	pinned := map[string]string{"SCRIPT_FILENAME": "pinned.wasm", "WASI_PINNED": "true"}
+	if w := serve(s, "GET", "/id", pinned); w.Code != http.StatusOK {
+		t.Fatalf("pinned: %d %s", w.Code, w.Body)
+	}
+	// 常驻的实例不会被关闭, 预算不足
+	other := func() int {
+		return serve(s, "GET", "/id", map[string]string{"SCRIPT_FILENAME": "other.wasm"}).Code
+	}
+	if code := other(); code != http.StatusServiceUnavailable {
+		t.Fatalf("other: %d, want 503", code)
+	}
+
+	pinned["WASI_PINNED"] = "false"
+	if w := serve(s, "GET", "/id", pinned); w.Code != http.StatusOK {
+		t.Fatalf("unpin: %d %s", w.Code, w.Body)
+	}
+	if code := other(); code != http.StatusOK {
+		t.Fatalf("other after unpin: %d, want 200", code)
+	}
+	if info, _ := s.Script("pinned.wasm"); info.WCGI != nil {
+		t.Errorf("idle instance should be evicted: %+v", info.WCGI)
+	}
+}
+
+func TestPinnedNotEvictedByCacheLimits(t *testing.T) {
+	s, _ := newGuestServer(t, wagi.WithCacheLimits(wagi.CacheLimits{Modules: 1, Instances: 1, Proxies: 1}))
+	pinned := map[string]string{"SCRIPT_FILENAME": "pinned.wasm", "WASI_PINNED": "true"}
+	id := serve(s, "GET", "/id", pinned).Body.String()
+	for _, name := range []string{"a.wasm", "b.wasm"} {
+		if w := serve(s, "GET", "/id", map[string]string{"SCRIPT_FILENAME": name}); w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", name, w.Code, w.Body)
+		}
+	}
+	if _, ok := s.Script("a.wasm"); ok {
+		t.Errorf("a.wasm should be evicted")
+	}
+	info, ok := s.Script("pinned.wasm")
+	if !ok || info.WCGI == nil || info.WCGI.State != "running" {
+		t.Fatalf("pinned.wasm should stay: %+v", info)
+	}
+	// 模块被淘汰后实例仍持有引用, 继续使用原来的实例
+	if next := serve(s, "GET", "/id", pinned).Body.String(); next != id {
+		t.Errorf("pinned.wasm restarted: %s, want %s", next, id)
+	}
+}
@@ -0,0 +1,268 @@
+package wagi
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimit 是令牌桶限流和并发限制, 零值表示不限制
+//
+// 超过速率时响应 429, 超过并发时排队等待, 队列已满或等待超时时响应 503
+type RateLimit struct {
+	Rate  float64 `yaml:"rate" json:"rate"`   // 每秒的请求数
+	Burst int     `yaml:"burst" json:"burst"` // 令牌桶的容量, 默认为 Rate 向上取整
+
+	MaxConcurrent int           `yaml:"max_concurrent" json:"max_concurrent"`
+	MaxQueue      int           `yaml:"max_queue" json:"max_queue"`         // 超过并发时最多排队的请求数
+	QueueTimeout  time.Duration `yaml:"queue_timeout" json:"queue_timeout"` // 排队的最长时间, 默认为 10 秒
+}
+
+// RateLimits 分别按脚本, 域名和 REMOTE_ADDR 限制请求
+type RateLimits struct {
+	Script RateLimit `yaml:"script" json:"script"`
+	Host   RateLimit `yaml:"host" json:"host"`
+	Client RateLimit `yaml:"client" json:"client"`
+}
+
+// LimitStats 是一个限流对象的状态
+type LimitStats struct {
+	Scope     string `json:"scope"`
+	Key       string `json:"key"`
+	InFlight  int    `json:"in_flight"`
+	Queued    int64  `json:"queued"`
+	Throttled int64  `json:"throttled"` // 超过速率被拒绝的请求数
+	Rejected  int64  `json:"rejected"`  // 超过并发被拒绝的请求数
+}
+
+type limiter struct {
+	cfg RateLimit
+
+	mux    sync.Mutex
+	tokens float64
+	last   time.Time
+
+	sem       chan struct{}
+	queued    atomic.Int64
+	throttled atomic.Int64
+	rejected  atomic.Int64
+	lastUsed  atomic.Int64
+}
+
+func newLimiter(cfg RateLimit) *limiter {
+	l := &limiter{cfg: cfg, last: time.Now()}
+	l.tokens = float64(l.burst())
+	if cfg.MaxConcurrent > 0 {
+		l.sem = make(chan struct{}, cfg.MaxConcurrent)
+	}
+	return l
+}
+
+func (l *limiter) burst() int {
+	if l.cfg.Burst > 0 {
+		return l.cfg.Burst
+	}
+	return int(math.Ceil(l.cfg.Rate))
+}
+
+// allow 取一个令牌, 没有令牌时返回需要等待的时间
+func (l *limiter) allow() (bool, time.Duration) {
+	if l.cfg.Rate <= 0 {
+		return true, 0
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := time.Now()
+	l.tokens = min(float64(l.burst()), l.tokens+now.Sub(l.last).Seconds()*l.cfg.Rate)
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	l.throttled.Add(1)
+	return false, time.Duration((1 - l.tokens) / l.cfg.Rate * float64(time.Second))
+}
+
+// refund 退还 allow 取走的令牌
+func (l *limiter) refund() {
+	if l.cfg.Rate <= 0 {
+		return
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.tokens = min(float64(l.burst()), l.tokens+1)
+}
+
+// acquire 占用一个并发, 队列已满或等待超时时返回 false
+func (l *limiter) acquire(ctx context.Context) bool {
+	if l.sem == nil {
+		return true
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+	}
+	if l.queued.Add(1) > int64(l.cfg.MaxQueue) {
+		l.queued.Add(-1)
+		l.rejected.Add(1)
+		return false
+	}
+	defer l.queued.Add(-1)
+	timeout := l.cfg.QueueTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	l.rejected.Add(1)
+	return false
+}
+
+func (l *limiter) release() {
+	if l.sem != nil {
+		<-l.sem
+	}
+}
+
+func (l *limiter) idle() bool {
+	return len(l.sem) == 0 && l.queued.Load() == 0
+}
+
+type limiterGroup struct {
+	scope string
+	cfg   RateLimit
+	items *Cache[*limiter]
+	swept atomic.Int64
+}
+
+func (g *limiterGroup) get(key string) *limiter {
+	now := time.Now()
+	if last := g.swept.Load(); now.Sub(time.Unix(0, last)) > time.Minute && g.swept.CompareAndSwap(last, now.UnixNano()) {
+		g.sweep(now.Add(-10 * time.Minute))
+	}
+	l := g.items.GetOrSet(key, func() *limiter { return newLimiter(g.cfg) })
+	l.lastUsed.Store(now.UnixNano())
+	return l
+}
+
+// sweep 删除 before 之后没有使用过的空闲对象, 避免 REMOTE_ADDR 过多时占用内存
+func (g *limiterGroup) sweep(before time.Time) {
+	for key, l := range g.items.Items() {
+		if l.lastUsed.Load() < before.UnixNano() && l.idle() {
+			g.items.Del(key)
+		}
+	}
+}
+
+type limiters []*limiterGroup
+
+func newLimiters(cfg RateLimits) limiters {
+	var ls limiters
+	for _, g := range []struct {
+		scope string
+		cfg   RateLimit
+	}{
+		{"script", cfg.Script},
+		{"host", cfg.Host},
+		{"client", cfg.Client},
+	} {
+		if g.cfg == (RateLimit{}) {
+			continue
+		}
+		ls = append(ls, &limiterGroup{scope: g.scope, cfg: g.cfg, items: NewCache[*limiter]()})
+	}
+	return ls
+}
+
+// limit 按脚本, 域名和客户端依次限流, 被拒绝时响应 429 或 503 并返回 false.
+// 被后面的限流拒绝时退还前面已取走的令牌. 通过时需要调用返回的 release
+func (ls limiters) limit(w http.ResponseWriter, r *http.Request, script string, params map[string]string) (release func(), ok bool) {
+	var acquired []*limiter
+	release = func() {
+		for _, l := range acquired {
+			l.release()
+		}
+	}
+	if len(ls) == 0 {
+		return release, true
+	}
+	keys := map[string]string{
+		"script": script,
+		"host":   requestHost(r, params),
+		"client": remoteIP(r, params),
+	}
+	items := make([]*limiter, len(ls))
+	for i, g := range ls {
+		items[i] = g.get(keys[g.scope])
+		if ok, wait := items[i].allow(); !ok {
+			for _, l := range items[:i] {
+				l.refund()
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "too many requests to the "+g.scope, http.StatusTooManyRequests)
+			return release, false
+		}
+	}
+	for i, l := range items {
+		if !l.acquire(r.Context()) {
+			release()
+			http.Error(w, "too many concurrent requests to the "+ls[i].scope, http.StatusServiceUnavailable)
+			return func() {}, false
+		}
+		acquired = append(acquired, l)
+	}
+	return release, true
+}
+
+func (ls limiters) stats() []LimitStats {
+	list := []LimitStats{}
+	for _, g := range ls {
+		for key, l := range g.items.Items() {
+			list = append(list, LimitStats{
+				Scope:     g.scope,
+				Key:       key,
+				InFlight:  len(l.sem),
+				Queued:    l.queued.Load(),
+				Throttled: l.throttled.Load(),
+				Rejected:  l.rejected.Load(),
+			})
+		}
+	}
+	slices.SortFunc(list, func(a, b LimitStats) int {
+		if c := strings.Compare(a.Scope, b.Scope); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	return list
+}
+
+// Limits 返回各个限流对象的状态
+func (s *Server) Limits() []LimitStats {
+	return s.limiters.stats()
+}
+
+func remoteIP(r *http.Request, params map[string]string) string {
+	addr := params["REMOTE_ADDR"]
+	if addr == "" {
+		addr = r.RemoteAddr
+	}
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+	return addr
+}
@@ -0,0 +1,126 @@
+package wagi_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shynome/go-wagi/wagi"
+)
+
+func TestRateLimits(t *testing.T) {
+	ctx := context.Background()
+	loading := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	// 模块加载时阻塞, 模拟正在处理的请求
+	res := wagi.ResolverFunc(func(r *http.Request, params map[string]string) (*wagi.Script, error) {
+		return &wagi.Script{
+			Name: "test",
+			Key:  r.URL.Path,
+			Load: func(ctx context.Context) ([]byte, error) {
+				if r.URL.Path == "/block" {
+					loading <- struct{}{}
+					<-unblock
+				}
+				return nil, errors.New("no module")
+			},
+		}, nil
+	})
+	s, err := wagi.New(ctx,
+		wagi.WithResolver(res),
+		wagi.WithParams(wagi.EmptyParams),
+		wagi.WithPolicy(wagi.Policy{Limits: wagi.RateLimits{
+			Script: wagi.RateLimit{MaxConcurrent: 1, MaxQueue: 1, QueueTimeout: 100 * time.Millisecond},
+			Client: wagi.RateLimit{Rate: 1, Burst: 3},
+		}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(ctx)
+
+	serve := func(p string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+		return w
+	}
+
+	blocked := make(chan int)
+	go func() { blocked <- serve("/block").Code }()
+	<-loading
+
+	queued := make(chan int)
+	go func() { queued <- serve("/queued").Code }()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if stats := s.Limits(); len(stats) > 0 && stats[1].Queued == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("request is not queued: %+v", s.Limits())
+		}
+	}
+	if code := serve("/full").Code; code != http.StatusServiceUnavailable {
+		t.Errorf("queue is full: %d, want 503", code)
+	}
+	if code := <-queued; code != http.StatusServiceUnavailable {
+		t.Errorf("queue timeout: %d, want 503", code)
+	}
+	close(unblock)
+	if code := <-blocked; code != http.StatusInternalServerError {
+		t.Errorf("blocked request: %d, want 500", code)
+	}
+
+	// 已经用完 3 个令牌
+	w := serve("/limited")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("rate limit: %d %v", w.Code, w.Header())
+	}
+	stats := s.Limits()
+	if len(stats) != 2 || stats[0].Scope != "client" || stats[0].Throttled != 1 || stats[1].Scope != "script" || stats[1].Rejected != 2 {
+		t.Errorf("stats: %+v", stats)
+	}
+}
+
+func TestRateLimitRefund(t *testing.T) {
+	ctx := context.Background()
+	res := wagi.ResolverFunc(func(r *http.Request, params map[string]string) (*wagi.Script, error) {
+		return &wagi.Script{
+			Name: "test",
+			Key:  "test",
+			Load: func(ctx context.Context) ([]byte, error) { return nil, errors.New("no module") },
+		}, nil
+	})
+	s, err := wagi.New(ctx,
+		wagi.WithResolver(res),
+		wagi.WithParams(wagi.EmptyParams),
+		wagi.WithPolicy(wagi.Policy{Limits: wagi.RateLimits{
+			Script: wagi.RateLimit{Rate: 1, Burst: 2},
+			Client: wagi.RateLimit{Rate: 1, Burst: 1},
+		}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(ctx)
+
+	serve := func(addr string) int {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := serve("10.0.0.1:1000"); code != http.StatusInternalServerError {
+		t.Fatalf("first request: %d", code)
+	}
+	// 被客户端限流拒绝的请求不占用脚本的令牌
+	if code := serve("10.0.0.1:1000"); code != http.StatusTooManyRequests {
+		t.Fatalf("client limit: %d, want 429", code)
+	}
+	if code := serve("10.0.0.2:1000"); code != http.StatusInternalServerError {
+		t.Errorf("another client: %d, script token should be refunded", code)
+	}
+}
@@ -0,0 +1,56 @@
+package wagi
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// guest 的线性内存只能在 guest 所在的 goroutine 中安全地读取.
+// 在 guest 调用读写和等待的 WASI 函数前记录内存大小, 其他 goroutine 读取记录的值
+var memoryProbes = map[string]bool{
+	"fd_read":     true,
+	"fd_write":    true,
+	"poll_oneoff": true,
+}
+
+type memoryKey struct{}
+
+// withMemoryRecorder 使 ctx 中运行的 guest 把线性内存的字节数记录到 mem
+func withMemoryRecorder(ctx context.Context, mem *atomic.Int64) context.Context {
+	return context.WithValue(ctx, memoryKey{}, mem)
+}
+
+type memoryListener struct{}
+
+func (memoryListener) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if !memoryProbes[def.Name()] {
+		return nil
+	}
+	return memoryListener{}
+}
+
+func (memoryListener) Before(ctx context.Context, mod api.Module, _ api.FunctionDefinition, _ []uint64, _ experimental.StackIterator) {
+	mem, ok := ctx.Value(memoryKey{}).(*atomic.Int64)
+	if !ok {
+		return
+	}
+	if m := mod.Memory(); m != nil {
+		mem.Store(int64(m.Size()))
+	}
+}
+
+func (memoryListener) After(context.Context, api.Module, api.FunctionDefinition, []uint64) {}
+
+func (memoryListener) Abort(context.Context, api.Module, api.FunctionDefinition, error) {}
+
+// instantiateWASI 在 rt 中实例化 WASI, 并记录 guest 调用 WASI 时的内存大小
+func instantiateWASI(ctx context.Context, rt wazero.Runtime) error {
+	ctx = experimental.WithFunctionListenerFactory(ctx, memoryListener{})
+	_, err := wasi_snapshot_preview1.Instantiate(ctx, rt)
+	return err
+}
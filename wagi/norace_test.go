@@ -0,0 +1,5 @@
+//go:build !race
+
+package wagi_test
+
+const raceEnabled = false
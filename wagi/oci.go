@@ -0,0 +1,414 @@
+package wagi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OCIRef 是 `oci://registry/repo:tag` 或 `oci://registry/repo@sha256:...` 形式的模块引用
+type OCIRef struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+func ParseOCIRef(s string) (ref OCIRef, err error) {
+	rest, ok := strings.CutPrefix(s, "oci://")
+	if !ok {
+		return ref, fmt.Errorf("oci ref must start with oci://: %s", s)
+	}
+	ref.Registry, rest, ok = strings.Cut(rest, "/")
+	if !ok || ref.Registry == "" || rest == "" {
+		return ref, fmt.Errorf("oci ref requires registry and repository: %s", s)
+	}
+	if repo, digest, ok := strings.Cut(rest, "@"); ok {
+		ref.Repository, ref.Digest = repo, digest
+		return ref, nil
+	}
+	ref.Repository, ref.Tag = rest, "latest"
+	// tag 中不含 /, 避免将 registry 端口误认为 tag
+	if i := strings.LastIndexByte(rest, ':'); i > strings.LastIndexByte(rest, '/') {
+		ref.Repository, ref.Tag = rest[:i], rest[i+1:]
+	}
+	return ref, nil
+}
+
+func (ref OCIRef) String() string {
+	if ref.Digest != "" {
+		return "oci://" + ref.Registry + "/" + ref.Repository + "@" + ref.Digest
+	}
+	return "oci://" + ref.Registry + "/" + ref.Repository + ":" + ref.Tag
+}
+
+// OCIResolver 从 OCI registry 拉取 SCRIPT_FILENAME 为 `oci://` 的模块,
+// 校验 layer digest 后按 digest 缓存在 CacheDir 中.
+//
+// tag 每隔 Interval 重新解析一次, 解析在后台进行, 期间继续使用旧的 digest.
+// 拉取失败后 RetryInterval 内不再访问 registry, 没有缓存时直接返回上次的错误
+type OCIResolver struct {
+	Client        *http.Client // 为 nil 时使用超时为 5 分钟的客户端
+	CacheDir      string
+	Interval      time.Duration // 默认为 5 分钟
+	RetryInterval time.Duration // 默认为 30 秒
+	// PlainHTTP 返回 true 的 registry 使用 http 访问, 为 nil 时 localhost 和 127.0.0.1 使用 http
+	PlainHTTP func(registry string) bool
+	// Credentials 返回 registry 的用户名和密码, 为 nil 或返回空时匿名访问
+	Credentials func(registry string) (username, password string)
+	Logger      *slog.Logger
+
+	tags   map[string]*ociTag
+	tokens map[string]string // registry/repository -> bearer token
+	mux    sync.Mutex
+}
+
+type ociTag struct {
+	mux        sync.Mutex
+	digest     string
+	file       string
+	resolvedAt time.Time
+	refreshing bool
+	err        error // 最近一次拉取失败的错误
+	failedAt   time.Time
+}
+
+var _ Resolver = (*OCIResolver)(nil)
+
+// layer 的 mediaType, 依次优先选择
+var ociWasmMediaTypes = []string{
+	"application/vnd.wasm.content.layer.v1+wasm",
+	"application/vnd.module.wasm.content.layer.v1+wasm",
+	"application/wasm",
+}
+
+func (or *OCIResolver) Resolve(r *http.Request, params map[string]string) (*Script, error) {
+	name := params["SCRIPT_FILENAME"]
+	ref, err := ParseOCIRef(name)
+	if err != nil {
+		return nil, err
+	}
+	t := or.tag(ref.String())
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	interval := or.Interval
+	if interval == 0 {
+		interval = 5 * time.Minute
+	}
+	retry := or.RetryInterval
+	if retry == 0 {
+		retry = 30 * time.Second
+	}
+	backoff := t.err != nil && time.Since(t.failedAt) < retry
+	switch {
+	case t.file == "" && backoff:
+		return nil, t.err
+	case t.file == "":
+		digest, file, err := or.pull(r.Context(), ref)
+		if err != nil {
+			// 请求取消导致的失败不影响后续请求
+			if r.Context().Err() == nil {
+				t.err, t.failedAt = err, time.Now()
+			}
+			return nil, err
+		}
+		t.digest, t.file, t.resolvedAt, t.err = digest, file, time.Now(), nil
+	case ref.Digest == "" && !t.refreshing && !backoff && time.Since(t.resolvedAt) > interval:
+		t.refreshing = true
+		go or.refresh(ref, t)
+	}
+	file := t.file
+	return &Script{
+		Name: name,
+		Key:  "oci-" + t.digest,
+		Load: func(ctx context.Context) ([]byte, error) {
+			return os.ReadFile(file)
+		},
+	}, nil
+}
+
+func (or *OCIResolver) tag(key string) *ociTag {
+	or.mux.Lock()
+	defer or.mux.Unlock()
+	if or.tags == nil {
+		or.tags = map[string]*ociTag{}
+	}
+	t, ok := or.tags[key]
+	if !ok {
+		t = &ociTag{}
+		or.tags[key] = t
+	}
+	return t
+}
+
+func (or *OCIResolver) refresh(ref OCIRef, t *ociTag) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+	digest, file, err := or.pull(ctx, ref)
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.refreshing = false
+	if err != nil {
+		or.logger().Warn("re-resolve oci tag failed", "ref", ref.String(), "err", err)
+		t.err, t.failedAt = err, time.Now()
+		return
+	}
+	t.err = nil
+	if digest != t.digest {
+		or.logger().Info("oci tag updated", "ref", ref.String(), "digest", digest)
+	}
+	t.digest, t.file, t.resolvedAt = digest, file, time.Now()
+}
+
+func (or *OCIResolver) logger() *slog.Logger {
+	if or.Logger != nil {
+		return or.Logger
+	}
+	return slog.Default()
+}
+
+// pull 解析 manifest 并下载 wasm layer, 返回 layer digest 和缓存文件路径
+func (or *OCIResolver) pull(ctx context.Context, ref OCIRef) (digest string, file string, err error) {
+	reference := ref.Digest
+	if reference == "" {
+		reference = ref.Tag
+	}
+	resp, err := or.get(ctx, ref, "/manifests/"+reference,
+		"application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.docker.distribution.manifest.v2+json",
+	)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	if ref.Digest != "" {
+		algo, want, _ := strings.Cut(ref.Digest, ":")
+		if algo != "sha256" {
+			return "", "", fmt.Errorf("unsupported manifest digest of %s", ref)
+		}
+		sum := sha256.Sum256(body)
+		if got := hex.EncodeToString(sum[:]); got != want {
+			return "", "", fmt.Errorf("manifest digest mismatch of %s: got sha256:%s", ref, got)
+		}
+	}
+	var manifest struct {
+		Layers []struct {
+			MediaType string `json:"mediaType"`
+			Digest    string `json:"digest"`
+			Size      int64  `json:"size"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return "", "", fmt.Errorf("decode manifest of %s: %w", ref, err)
+	}
+	if len(manifest.Layers) == 0 {
+		return "", "", fmt.Errorf("%s has no layers", ref)
+	}
+	layer := manifest.Layers[0]
+	if len(manifest.Layers) > 1 {
+		found := false
+		for _, mt := range ociWasmMediaTypes {
+			for _, l := range manifest.Layers {
+				if !found && l.MediaType == mt {
+					layer, found = l, true
+				}
+			}
+		}
+		if !found {
+			return "", "", fmt.Errorf("%s has no wasm layer", ref)
+		}
+	}
+
+	algo, hexsum, ok := strings.Cut(layer.Digest, ":")
+	if !ok || algo != "sha256" {
+		return "", "", fmt.Errorf("unsupported layer digest %q of %s", layer.Digest, ref)
+	}
+	name := "sha256-" + hexsum + ".wasm"
+	file = filepath.Join(or.cacheDir(), name)
+	if _, err := os.Stat(file); err == nil {
+		return layer.Digest, file, nil
+	}
+
+	blob, err := or.get(ctx, ref, "/blobs/"+layer.Digest)
+	if err != nil {
+		return "", "", err
+	}
+	defer blob.Body.Close()
+	b, err := io.ReadAll(blob.Body)
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256(b)
+	if got := hex.EncodeToString(sum[:]); got != hexsum {
+		return "", "", fmt.Errorf("layer digest mismatch of %s: want %s, got sha256:%s", ref, layer.Digest, got)
+	}
+	file, err = writeCacheFile(or.cacheDir(), name, b)
+	return layer.Digest, file, err
+}
+
+func (or *OCIResolver) cacheDir() string {
+	if or.CacheDir == "" {
+		return filepath.Join(os.TempDir(), "go-wagi")
+	}
+	return or.CacheDir
+}
+
+// get 请求 registry 的 v2 api, 遇到 401 时按 WWW-Authenticate 获取 bearer token 后重试
+func (or *OCIResolver) get(ctx context.Context, ref OCIRef, p string, accept ...string) (*http.Response, error) {
+	scheme := "https"
+	plain := or.PlainHTTP
+	if plain == nil {
+		plain = func(registry string) bool {
+			host := registry
+			if h, _, ok := strings.Cut(registry, ":"); ok {
+				host = h
+			}
+			return host == "localhost" || host == "127.0.0.1"
+		}
+	}
+	if plain(ref.Registry) {
+		scheme = "http"
+	}
+	u := scheme + "://" + ref.Registry + "/v2/" + ref.Repository + p
+	tokenKey := ref.Registry + "/" + ref.Repository
+
+	do := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range accept {
+			req.Header.Add("Accept", a)
+		}
+		or.mux.Lock()
+		token := or.tokens[tokenKey]
+		or.mux.Unlock()
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else if user, pass := or.credentials(ref.Registry); user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		return or.client().Do(req)
+	}
+	resp, err := do()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		token, err := or.token(ctx, ref, challenge)
+		if err != nil {
+			return nil, err
+		}
+		or.mux.Lock()
+		if or.tokens == nil {
+			or.tokens = map[string]string{}
+		}
+		or.tokens[tokenKey] = token
+		or.mux.Unlock()
+		if resp, err = do(); err != nil {
+			return nil, err
+		}
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrScriptNotFound, ref)
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("get %s: %s", u, resp.Status)
+	}
+}
+
+// token 按 Bearer realm="...",service="...",scope="..." 获取 token
+func (or *OCIResolver) token(ctx context.Context, ref OCIRef, challenge string) (string, error) {
+	params, ok := strings.CutPrefix(challenge, "Bearer ")
+	if !ok {
+		return "", fmt.Errorf("unsupported auth challenge from %s: %q", ref.Registry, challenge)
+	}
+	attrs := map[string]string{}
+	for _, kv := range strings.Split(params, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		attrs[k] = strings.Trim(v, `"`)
+	}
+	realm, err := url.Parse(attrs["realm"])
+	if err != nil || attrs["realm"] == "" {
+		return "", fmt.Errorf("bad auth realm from %s: %q", ref.Registry, challenge)
+	}
+	q := realm.Query()
+	if s := attrs["service"]; s != "" {
+		q.Set("service", s)
+	}
+	scope := attrs["scope"]
+	if scope == "" {
+		scope = "repository:" + ref.Repository + ":pull"
+	}
+	q.Set("scope", scope)
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if user, pass := or.credentials(ref.Registry); user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+	resp, err := or.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get token from %s: %s", realm.Host, resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+	return "", errors.New("empty token from " + realm.Host)
+}
+
+func (or *OCIResolver) credentials(registry string) (string, string) {
+	if or.Credentials == nil {
+		return "", ""
+	}
+	return or.Credentials(registry)
+}
+
+// ociClient 是默认的客户端, 避免 registry 没有响应时一直等待
+var ociClient = &http.Client{Timeout: 5 * time.Minute}
+
+func (or *OCIResolver) client() *http.Client {
+	if or.Client != nil {
+		return or.Client
+	}
+	return ociClient
+}
@@ -0,0 +1,212 @@
+package wagi_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shynome/err0/try"
+	"github.com/shynome/go-wagi/wagi"
+)
+
+// registry 是一个最小的 OCI registry, 只支持拉取 manifest 和 blob
+type registry struct {
+	mux       sync.Mutex
+	manifests map[string][]byte // repo:tag 和 repo@digest -> manifest
+	blobs     map[string][]byte // digest -> content
+	token     string
+	// corrupt 为 true 时返回错误的 blob 内容
+	corrupt bool
+	// manifest 的请求次数
+	pulls int
+}
+
+func (reg *registry) push(repo, tag, content string) string {
+	reg.mux.Lock()
+	defer reg.mux.Unlock()
+	sum := sha256.Sum256([]byte(content))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	m := try.To1(json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"layers": []map[string]any{
+			{"mediaType": "application/vnd.wasm.config.v0+json", "digest": "sha256:00"},
+			{"mediaType": "application/vnd.wasm.content.layer.v1+wasm", "digest": digest},
+		},
+	}))
+	msum := sha256.Sum256(m)
+	reg.manifests[repo+":"+tag] = m
+	reg.manifests[repo+"@sha256:"+hex.EncodeToString(msum[:])] = m
+	reg.blobs[digest] = []byte(content)
+	return digest
+}
+
+// pinned 返回 tag 当前的 manifest digest
+func (reg *registry) pinned(repo, tag string) string {
+	reg.mux.Lock()
+	defer reg.mux.Unlock()
+	sum := sha256.Sum256(reg.manifests[repo+":"+tag])
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (reg *registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		json.NewEncoder(w).Encode(map[string]string{"token": reg.token})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+reg.token {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test"`, r.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	reg.mux.Lock()
+	defer reg.mux.Unlock()
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	if repo, ref, ok := strings.Cut(p, "/manifests/"); ok {
+		reg.pulls++
+		sep := ":"
+		if strings.HasPrefix(ref, "sha256:") {
+			sep = "@"
+		}
+		m, ok := reg.manifests[repo+sep+ref]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		w.Write(m)
+		return
+	}
+	if _, digest, ok := strings.Cut(p, "/blobs/"); ok {
+		b, ok := reg.blobs[digest]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if reg.corrupt {
+			b = append([]byte("x"), b...)
+		}
+		w.Write(b)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func TestOCIResolver(t *testing.T) {
+	reg := &registry{manifests: map[string][]byte{}, blobs: map[string][]byte{}, token: "t0ken"}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	res := &wagi.OCIResolver{CacheDir: t.TempDir(), Interval: time.Millisecond}
+	resolve := func(name string) (*wagi.Script, error) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		return res.Resolve(r, map[string]string{"SCRIPT_FILENAME": name})
+	}
+	name := "oci://" + host + "/apps/hello:v1"
+
+	d1 := reg.push("apps/hello", "v1", "module v1")
+	sc := try.To1(resolve(name))
+	if sc.Key != "oci-"+d1 {
+		t.Errorf("key %s, want oci-%s", sc.Key, d1)
+	}
+	if b := try.To1(sc.Load(t.Context())); string(b) != "module v1" {
+		t.Errorf("loaded %q", b)
+	}
+
+	d2 := reg.push("apps/hello", "v1", "module v2")
+	time.Sleep(5 * time.Millisecond)
+	// 触发后台重新解析, 本次仍返回旧的 digest
+	try.To1(resolve(name))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sc = try.To1(resolve(name))
+		if sc.Key == "oci-"+d2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sc.Key != "oci-"+d2 {
+		t.Errorf("tag is not re-resolved, key %s", sc.Key)
+	}
+
+	if _, err := resolve("oci://" + host + "/apps/missing:v1"); err == nil {
+		t.Error("missing tag should fail")
+	}
+
+	// 固定 digest 时校验 manifest
+	pinned := reg.pinned("apps/hello", "v1")
+	if sc := try.To1(resolve("oci://" + host + "/apps/hello@" + pinned)); sc.Key != "oci-"+d2 {
+		t.Errorf("pinned key %s, want oci-%s", sc.Key, d2)
+	}
+	reg.push("apps/tampered", "v1", "module v1")
+	pinned = reg.pinned("apps/tampered", "v1")
+	reg.push("apps/tampered", "v1", "module v2")
+	reg.mux.Lock()
+	reg.manifests["apps/tampered@"+pinned] = reg.manifests["apps/tampered:v1"]
+	reg.mux.Unlock()
+	if _, err := resolve("oci://" + host + "/apps/tampered@" + pinned); err == nil || !strings.Contains(err.Error(), "manifest digest mismatch") {
+		t.Errorf("manifest digest should be verified, err %v", err)
+	}
+
+	reg.mux.Lock()
+	reg.corrupt = true
+	reg.mux.Unlock()
+	reg.push("apps/corrupt", "v1", "corrupt")
+	if _, err := resolve("oci://" + host + "/apps/corrupt:v1"); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("digest should be verified, err %v", err)
+	}
+}
+
+func TestOCIResolverRetry(t *testing.T) {
+	reg := &registry{manifests: map[string][]byte{}, blobs: map[string][]byte{}, token: "t0ken"}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	res := &wagi.OCIResolver{CacheDir: t.TempDir(), RetryInterval: 200 * time.Millisecond}
+	resolve := func() error {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		_, err := res.Resolve(r, map[string]string{"SCRIPT_FILENAME": "oci://" + host + "/apps/later:v1"})
+		return err
+	}
+	pulls := func() int {
+		reg.mux.Lock()
+		defer reg.mux.Unlock()
+		return reg.pulls
+	}
+	first := resolve()
+	if first == nil {
+		t.Fatal("missing tag should fail")
+	}
+	// 重试间隔内直接返回上次的错误
+	if err := resolve(); err == nil || err.Error() != first.Error() || pulls() != 1 {
+		t.Errorf("should not retry the registry: %v, %d pulls", err, pulls())
+	}
+	reg.push("apps/later", "v1", "module v1")
+	time.Sleep(200 * time.Millisecond)
+	if err := resolve(); err != nil || pulls() != 2 {
+		t.Errorf("should retry after the interval: %v, %d pulls", err, pulls())
+	}
+}
+
+func TestParseOCIRef(t *testing.T) {
+	cases := map[string]wagi.OCIRef{
+		"oci://ghcr.io/a/b:v1":          {Registry: "ghcr.io", Repository: "a/b", Tag: "v1"},
+		"oci://localhost:5000/a":        {Registry: "localhost:5000", Repository: "a", Tag: "latest"},
+		"oci://r.io/a@sha256:abc":       {Registry: "r.io", Repository: "a", Digest: "sha256:abc"},
+		"oci://localhost:5000/a/b:main": {Registry: "localhost:5000", Repository: "a/b", Tag: "main"},
+	}
+	for s, want := range cases {
+		ref := try.To1(wagi.ParseOCIRef(s))
+		if ref != want {
+			t.Errorf("%s: got %+v", s, ref)
+		}
+	}
+}
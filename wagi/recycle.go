@@ -0,0 +1,65 @@
+package wagi
+
+import (
+	"fmt"
+	"time"
+)
+
+// Recycle 是 wcgi 实例的重启策略, 零值表示不重启
+//
+// go 编译的 guest 堆内存只增不减, 长期运行的实例可以定期重启.
+// 达到条件后新的请求交给后台启动的新实例, 旧实例处理完正在进行的请求后关闭
+type Recycle struct {
+	MaxRequests  int64         // 处理多少个请求后重启
+	MaxAge       time.Duration // 运行多久后重启
+	MaxMemory    int64         // guest 线性内存超过多少字节后重启
+	DrainTimeout time.Duration // 等待旧实例处理完请求的最长时间, 默认为 30 秒
+}
+
+// due 返回实例需要重启的原因, 不需要时返回空字符串
+func (rc Recycle) due(proxy *ProxyItem) string {
+	switch {
+	case rc.MaxRequests > 0 && proxy.requests.Load() >= rc.MaxRequests:
+		return fmt.Sprintf("served %d requests", proxy.requests.Load())
+	case rc.MaxAge > 0 && time.Since(proxy.StartedAt) >= rc.MaxAge:
+		return fmt.Sprintf("running for %s", time.Since(proxy.StartedAt).Round(time.Second))
+	case rc.MaxMemory > 0 && int64(proxy.MemoryPages())*65536 > rc.MaxMemory:
+		return fmt.Sprintf("memory grew to %d pages", proxy.MemoryPages())
+	}
+	return ""
+}
+
+// recycleProxy 在实例达到重启条件时将其移出缓存, 并在后台启动新的实例和关闭旧的实例
+func (s *Server) recycleProxy(script string, proxy *ProxyItem, start func() (*ProxyItem, error)) {
+	reason := s.recycle.due(proxy)
+	if reason == "" || !s.dropProxy(proxy) {
+		return
+	}
+	s.logger.Info("recycle wcgi instance", "script", script, "reason", reason)
+	// 请求结束后会释放它持有的模块引用, 启动完成前由这里持有
+	wasm := proxy.wasm
+	if !wasm.acquire() {
+		go s.drain(proxy)
+		return
+	}
+	go func() {
+		defer wasm.release()
+		if _, err := start(); err != nil {
+			s.logger.Warn("start wcgi instance failed", "script", script, "err", err)
+		}
+	}()
+	go s.drain(proxy)
+}
+
+// drain 等待实例处理完正在进行的请求后关闭实例
+func (s *Server) drain(proxy *ProxyItem) {
+	timeout := s.recycle.DrainTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	for proxy.active.Load() > 0 && !proxy.Closed() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	proxy.Close()
+}
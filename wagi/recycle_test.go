@@ -0,0 +1,96 @@
+package wagi_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/shynome/go-wagi/wagi"
+)
+
+// recycled 等待实例被替换, 返回新实例的 id
+func recycled(t *testing.T, s *wagi.Server, id string) string {
+	t.Helper()
+	var next string
+	eventually(t, 5*time.Second, func() bool {
+		next = do(s, "GET", "/id").Body.String()
+		return next != id
+	}, "instance should be recycled")
+	return next
+}
+
+func TestRecycleRequests(t *testing.T) {
+	s, log := newGuestServer(t, wagi.WithRecycle(wagi.Recycle{MaxRequests: 2}))
+	id := do(s, "GET", "/id").Body.String()
+	if next := do(s, "GET", "/id").Body.String(); next != id {
+		t.Fatalf("recycled too early")
+	}
+	recycled(t, s, id)
+	if log.Count("reason=\"served 2 requests\"") != 1 {
+		t.Errorf("should log the reason")
+	}
+}
+
+func TestRecycleAge(t *testing.T) {
+	skipRace(t)
+	s, log := newGuestServer(t, wagi.WithRecycle(wagi.Recycle{MaxAge: 300 * time.Millisecond}))
+	id := do(s, "GET", "/id").Body.String()
+	if next := do(s, "GET", "/id").Body.String(); next != id {
+		t.Fatalf("recycled too early")
+	}
+	time.Sleep(300 * time.Millisecond)
+	// 达到条件的请求仍由旧实例处理
+	if next := do(s, "GET", "/id").Body.String(); next != id {
+		t.Fatalf("request should be served by the old instance")
+	}
+	recycled(t, s, id)
+	if log.Count("reason=\"running for") != 1 {
+		t.Errorf("should log the reason")
+	}
+}
+
+func TestRecycleMemory(t *testing.T) {
+	s, log := newGuestServer(t, wagi.WithRecycle(wagi.Recycle{MaxMemory: guestMemory(t) + 8<<20}))
+	id := do(s, "GET", "/id").Body.String()
+	if next := do(s, "GET", "/id").Body.String(); next != id {
+		t.Fatalf("recycled too early")
+	}
+	do(s, "GET", "/grow")
+	recycled(t, s, id)
+	if log.Count("reason=\"memory grew to") != 1 {
+		t.Errorf("should log the reason")
+	}
+}
+
+func TestRecycleDrain(t *testing.T) {
+	s, _ := newGuestServer(t, wagi.WithRecycle(wagi.Recycle{MaxRequests: 2}))
+	id := do(s, "GET", "/id").Body.String()
+	done := make(chan string)
+	go func() { done <- do(s, "GET", "/sleep?d=500ms").Body.String() }()
+	time.Sleep(100 * time.Millisecond)
+	// 第三个请求触发重启, 旧实例等待正在处理的请求完成后关闭
+	do(s, "GET", "/id")
+	recycled(t, s, id)
+	if got := <-done; got != id {
+		t.Errorf("in-flight request: %q, want %q", got, id)
+	}
+}
+
+func TestRecycleDrainTimeout(t *testing.T) {
+	s, _ := newGuestServer(t, wagi.WithRecycle(wagi.Recycle{MaxRequests: 2, DrainTimeout: 200 * time.Millisecond}))
+	id := do(s, "GET", "/id").Body.String()
+	done := make(chan int)
+	// POST 请求不会在新的实例上重试
+	go func() { done <- do(s, "POST", "/sleep?d=5s").Code }()
+	time.Sleep(100 * time.Millisecond)
+	do(s, "GET", "/id")
+	recycled(t, s, id)
+	select {
+	case code := <-done:
+		if code != http.StatusBadGateway {
+			t.Errorf("in-flight request: %d, want 502", code)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("drain should give up after DrainTimeout")
+	}
+}
@@ -0,0 +1,325 @@
+package wagi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrScriptNotFound 表示请求没有对应的脚本, 会响应 404
+var ErrScriptNotFound = errors.New("script not found")
+
+// Script 是 [Resolver] 解析出的待运行模块
+type Script struct {
+	// Name 是脚本的标识, 同一个 Name 共用 wcgi 实例, 也用于日志和管理接口
+	Name string
+	// Key 标识模块的内容, 内容变化时 Key 也必须变化, 相同 Key 的编译结果会被复用
+	Key string
+	// Load 读取模块内容, 仅在需要编译时调用
+	Load func(ctx context.Context) ([]byte, error)
+}
+
+// Resolver 将请求映射到需要运行的模块,
+// 可以修改 params, 例如设置 SCRIPT_NAME 和 PATH_INFO
+type Resolver interface {
+	Resolve(r *http.Request, params map[string]string) (*Script, error)
+}
+
+// ResolverFunc 将普通函数适配为 [Resolver]
+type ResolverFunc func(r *http.Request, params map[string]string) (*Script, error)
+
+func (f ResolverFunc) Resolve(r *http.Request, params map[string]string) (*Script, error) {
+	return f(r, params)
+}
+
+// LocalResolver 运行 SCRIPT_FILENAME 指向的本地文件, 是默认的 [Resolver]
+type LocalResolver struct{}
+
+var _ Resolver = LocalResolver{}
+
+func (LocalResolver) Resolve(r *http.Request, params map[string]string) (*Script, error) {
+	script := params["SCRIPT_FILENAME"]
+	if script == "" {
+		return nil, fmt.Errorf("%w: SCRIPT_FILENAME is empty", ErrScriptNotFound)
+	}
+	finfo, err := os.Stat(script)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrScriptNotFound, script)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Script{
+		Name: script,
+		Key:  fmt.Sprintf("file-%s-%d", script, finfo.ModTime().Unix()),
+		Load: func(ctx context.Context) ([]byte, error) {
+			return os.ReadFile(script)
+		},
+	}, nil
+}
+
+// SchemeResolver 根据 SCRIPT_FILENAME 的 scheme (如 `https://`) 选择 [Resolver],
+// 没有 scheme 或没有对应的 Resolver 时使用 Default
+type SchemeResolver struct {
+	Schemes map[string]Resolver
+	Default Resolver
+}
+
+var _ Resolver = (*SchemeResolver)(nil)
+
+func (sr *SchemeResolver) Resolve(r *http.Request, params map[string]string) (*Script, error) {
+	if scheme, _, ok := strings.Cut(params["SCRIPT_FILENAME"], "://"); ok {
+		if res, ok := sr.Schemes[scheme]; ok {
+			return res.Resolve(r, params)
+		}
+	}
+	if sr.Default == nil {
+		return LocalResolver{}.Resolve(r, params)
+	}
+	return sr.Default.Resolve(r, params)
+}
+
+// FSResolver 根据请求路径在 FS 中查找模块, 适用于目录和 embed.FS
+//
+// 对于请求 /a/b/c, 依次查找 a/b/c.wasm, a/b/c/index.wasm, a/b.wasm, a/b/index.wasm ... index.wasm,
+// 找到的模块路径作为 SCRIPT_NAME, 剩余部分作为 PATH_INFO
+type FSResolver struct {
+	FS fs.FS
+	// Root 是 FS 对应的本地目录, 非空时作为 Script.Name 的前缀和默认的 DOCUMENT_ROOT
+	Root  string
+	Ext   string // 模块文件的后缀, 默认为 .wasm
+	Index string // 目录的默认模块, 默认为 index
+
+	hashes sync.Map // name -> content hash, 用于没有修改时间的 FS
+}
+
+var _ Resolver = (*FSResolver)(nil)
+
+// DirResolver 在本地目录 dir 中根据请求路径查找模块
+func DirResolver(dir string) *FSResolver {
+	return &FSResolver{FS: os.DirFS(dir), Root: dir}
+}
+
+func (fr *FSResolver) Resolve(r *http.Request, params map[string]string) (*Script, error) {
+	ext, index := fr.Ext, fr.Index
+	if ext == "" {
+		ext = ".wasm"
+	}
+	if index == "" {
+		index = "index"
+	}
+	p := path.Clean("/" + r.URL.Path)
+	// 没有找到模块时也设置, 用于查找静态文件
+	if params["DOCUMENT_ROOT"] == "" && fr.Root != "" {
+		params["DOCUMENT_ROOT"] = fr.Root
+	}
+	for scriptName := p; ; scriptName = path.Dir(scriptName) {
+		dir := strings.TrimPrefix(scriptName, "/")
+		candidates := []string{path.Join(dir, index+ext)}
+		if dir != "" {
+			candidates = []string{dir + ext, path.Join(dir, index+ext)}
+		}
+		for _, name := range candidates {
+			finfo, err := fs.Stat(fr.FS, name)
+			if errors.Is(err, fs.ErrNotExist) || (err == nil && finfo.IsDir()) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			params["SCRIPT_NAME"] = strings.TrimSuffix(scriptName, "/")
+			params["PATH_INFO"] = strings.TrimPrefix(p, params["SCRIPT_NAME"])
+			return fr.script(name, finfo)
+		}
+		if scriptName == "/" {
+			break
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrScriptNotFound, p)
+}
+
+func (fr *FSResolver) script(name string, finfo fs.FileInfo) (*Script, error) {
+	load := func(ctx context.Context) ([]byte, error) {
+		return fs.ReadFile(fr.FS, name)
+	}
+	scriptName := name
+	if fr.Root != "" {
+		scriptName = filepath.Join(fr.Root, filepath.FromSlash(name))
+	}
+	if mtime := finfo.ModTime(); !mtime.IsZero() {
+		return &Script{
+			Name: scriptName,
+			Key:  fmt.Sprintf("fs-%s-%d", scriptName, mtime.UnixNano()),
+			Load: load,
+		}, nil
+	}
+	// embed.FS 没有修改时间, 内容不会改变, 只需计算一次 hash
+	hash, ok := fr.hashes.Load(name)
+	if !ok {
+		b, err := load(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(b)
+		hash, _ = fr.hashes.LoadOrStore(name, hex.EncodeToString(sum[:]))
+	}
+	return &Script{
+		Name: scriptName,
+		Key:  fmt.Sprintf("fs-%s-%s", scriptName, hash),
+		Load: load,
+	}, nil
+}
+
+// HTTPResolver 从 SCRIPT_FILENAME 指向的 http(s) 地址下载模块, 并缓存在 CacheDir 中
+//
+// 每隔 TTL 使用 ETag/Last-Modified 重新校验一次, 校验失败时继续使用已缓存的模块,
+// 没有缓存时返回上次的错误, 都在 TTL 后才再次请求
+type HTTPResolver struct {
+	Client   *http.Client // 为 nil 时使用超时为 5 分钟的客户端
+	CacheDir string
+	TTL      time.Duration // 默认为 1 分钟, 负数表示每次都重新校验
+
+	entries map[string]*httpEntry
+	mux     sync.Mutex
+}
+
+type httpEntry struct {
+	mux          sync.Mutex
+	file         string
+	hash         string
+	etag         string
+	lastModified string
+	checked      time.Time // 上次请求的时间, 包括失败的请求
+	err          error     // 上次请求的错误
+}
+
+// fetchClient 是默认的客户端, 避免服务端没有响应时一直等待
+var fetchClient = &http.Client{Timeout: 5 * time.Minute}
+
+var _ Resolver = (*HTTPResolver)(nil)
+
+func (hr *HTTPResolver) Resolve(r *http.Request, params map[string]string) (*Script, error) {
+	u := params["SCRIPT_FILENAME"]
+	hr.mux.Lock()
+	if hr.entries == nil {
+		hr.entries = map[string]*httpEntry{}
+	}
+	e, ok := hr.entries[u]
+	if !ok {
+		e = &httpEntry{}
+		hr.entries[u] = e
+	}
+	hr.mux.Unlock()
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	ttl := hr.TTL
+	if ttl == 0 {
+		ttl = time.Minute
+	}
+	if e.checked.IsZero() || time.Since(e.checked) > ttl {
+		err := hr.fetch(r.Context(), u, e)
+		// 请求被取消不算失败, 下次请求时重试
+		if err == nil || r.Context().Err() == nil {
+			e.checked, e.err = time.Now(), err
+		}
+		if err != nil && e.file == "" {
+			return nil, err
+		}
+	}
+	if e.file == "" {
+		return nil, e.err
+	}
+	file := e.file
+	return &Script{
+		Name: u,
+		Key:  "http-" + u + "-" + e.hash,
+		Load: func(ctx context.Context) ([]byte, error) {
+			return os.ReadFile(file)
+		},
+	}, nil
+}
+
+func (hr *HTTPResolver) fetch(ctx context.Context, u string, e *httpEntry) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if e.file != "" {
+		if e.etag != "" {
+			req.Header.Set("If-None-Match", e.etag)
+		}
+		if e.lastModified != "" {
+			req.Header.Set("If-Modified-Since", e.lastModified)
+		}
+	}
+	client := hr.Client
+	if client == nil {
+		client = fetchClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && e.file != "":
+		return nil
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%w: %s", ErrScriptNotFound, u)
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("fetch %s: %s", u, resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(b)
+	hash := hex.EncodeToString(sum[:])
+	file, err := writeCacheFile(hr.CacheDir, hash+".wasm", b)
+	if err != nil {
+		return err
+	}
+	e.file, e.hash = file, hash
+	e.etag = resp.Header.Get("ETag")
+	e.lastModified = resp.Header.Get("Last-Modified")
+	return nil
+}
+
+// writeCacheFile 原子地写入缓存文件, 文件名为内容 hash, 已存在时直接返回
+func writeCacheFile(dir, name string, b []byte) (string, error) {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "go-wagi")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	file := filepath.Join(dir, name)
+	if _, err := os.Stat(file); err == nil {
+		return file, nil
+	}
+	f, err := os.CreateTemp(dir, name+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return file, os.Rename(f.Name(), file)
+}
@@ -0,0 +1,152 @@
+package wagi_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/shynome/err0/try"
+	"github.com/shynome/go-wagi/wagi"
+)
+
+func TestFSResolver(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.wasm":     {Data: []byte("index")},
+		"api.wasm":       {Data: []byte("api")},
+		"a/index.wasm":   {Data: []byte("a")},
+		"a/b/other.txt":  {Data: []byte("other")},
+		"nested/c.wasm":  {Data: []byte("c")},
+		"nested/c/x.txt": {Data: []byte("x")},
+	}
+	res := &wagi.FSResolver{FS: fsys}
+	cases := []struct {
+		path, name, scriptName, pathInfo string
+	}{
+		{"/", "index.wasm", "", "/"},
+		{"/hello", "index.wasm", "", "/hello"},
+		{"/api", "api.wasm", "/api", ""},
+		{"/api/users/1", "api.wasm", "/api", "/users/1"},
+		{"/a/b/c", "a/index.wasm", "/a", "/b/c"},
+		{"/nested/c/d", "nested/c.wasm", "/nested/c", "/d"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, c.path, nil)
+		params := map[string]string{}
+		sc := try.To1(res.Resolve(r, params))
+		if sc.Name != c.name {
+			t.Errorf("%s: name %s, want %s", c.path, sc.Name, c.name)
+		}
+		if got := params["SCRIPT_NAME"]; got != c.scriptName {
+			t.Errorf("%s: SCRIPT_NAME %q, want %q", c.path, got, c.scriptName)
+		}
+		if got := params["PATH_INFO"]; got != c.pathInfo {
+			t.Errorf("%s: PATH_INFO %q, want %q", c.path, got, c.pathInfo)
+		}
+		if b := try.To1(sc.Load(r.Context())); string(b) != string(fsys[c.name].Data) {
+			t.Errorf("%s: loaded %q", c.path, b)
+		}
+	}
+
+	empty := &wagi.FSResolver{FS: fstest.MapFS{"a.txt": {}}}
+	r := httptest.NewRequest(http.MethodGet, "/a", nil)
+	if _, err := empty.Resolve(r, map[string]string{}); err == nil {
+		t.Error("should not found")
+	}
+}
+
+func TestHTTPResolver(t *testing.T) {
+	var (
+		body    atomic.Value
+		fetched atomic.Int32
+	)
+	body.Store("v1")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := `"` + body.Load().(string) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fetched.Add(1)
+		w.Header().Set("ETag", etag)
+		io.WriteString(w, body.Load().(string))
+	}))
+	defer srv.Close()
+
+	res := &wagi.HTTPResolver{CacheDir: t.TempDir(), TTL: -1}
+	resolve := func() *wagi.Script {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		return try.To1(res.Resolve(r, map[string]string{"SCRIPT_FILENAME": srv.URL + "/index.wasm"}))
+	}
+
+	sc1 := resolve()
+	sc2 := resolve()
+	if sc1.Key != sc2.Key {
+		t.Error("key should not change when not modified")
+	}
+	if n := fetched.Load(); n != 1 {
+		t.Errorf("fetched %d times, want 1", n)
+	}
+
+	body.Store("v2")
+	sc3 := resolve()
+	if sc3.Key == sc1.Key {
+		t.Error("key should change when modified")
+	}
+	if b := try.To1(sc3.Load(t.Context())); string(b) != "v2" {
+		t.Errorf("loaded %q", b)
+	}
+}
+
+func TestHTTPResolverBackoff(t *testing.T) {
+	var (
+		fetched atomic.Int32
+		broken  atomic.Bool
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched.Add(1)
+		if broken.Load() || r.URL.Path == "/missing.wasm" {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, "v1")
+	}))
+	defer srv.Close()
+
+	res := &wagi.HTTPResolver{CacheDir: t.TempDir(), TTL: 100 * time.Millisecond}
+	resolve := func(name string) (*wagi.Script, error) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		return res.Resolve(r, map[string]string{"SCRIPT_FILENAME": srv.URL + name})
+	}
+
+	// 没有缓存时在 TTL 内返回上次的错误
+	for range 3 {
+		if _, err := resolve("/missing.wasm"); err == nil {
+			t.Fatal("should fail")
+		}
+	}
+	if n := fetched.Swap(0); n != 1 {
+		t.Errorf("missing: fetched %d times, want 1", n)
+	}
+
+	sc := try.To1(resolve("/index.wasm"))
+	broken.Store(true)
+	time.Sleep(150 * time.Millisecond)
+	// 校验失败后继续使用缓存, TTL 内不再请求
+	for range 3 {
+		if got := try.To1(resolve("/index.wasm")); got.Key != sc.Key {
+			t.Errorf("key %s, want %s", got.Key, sc.Key)
+		}
+	}
+	if n := fetched.Swap(0); n != 2 {
+		t.Errorf("index: fetched %d times, want 2", n)
+	}
+	time.Sleep(150 * time.Millisecond)
+	try.To1(resolve("/index.wasm"))
+	if n := fetched.Load(); n != 1 {
+		t.Errorf("should fetch again after TTL, fetched %d times", n)
+	}
+}
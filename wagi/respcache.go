@@ -0,0 +1,423 @@
+package wagi
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ResponseCache 按 guest 响应的 Cache-Control, Expires 和 Vary 缓存 GET 响应, 命中时不再运行模块.
+//
+// 只缓存声明了 max-age, s-maxage 或 Expires 且没有 no-store, no-cache, private 和 Set-Cookie 的响应,
+// 缓存 key 包含模块的 Key, 模块更新后旧的缓存不再命中.
+// 超过 MaxSize 时按最近最少使用淘汰
+type ResponseCache struct {
+	MaxSize      int64 // 缓存响应体的总大小, 默认为 64MB
+	MaxEntrySize int64 // 单个响应体的最大大小, 默认为 1MB
+	// Dir 非空时响应体保存在该目录中, 内存中只保留响应头
+	Dir string
+
+	entries map[string]*list.Element // key -> *cachedResponse
+	lru     list.List
+	size    int64
+	mux     sync.Mutex
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type cachedResponse struct {
+	key      string
+	base     string // 不含 Vary 的 key
+	script   string
+	vary     []string
+	status   int
+	header   http.Header
+	body     []byte
+	file     string
+	size     int64
+	storedAt time.Time
+	expires  time.Time
+}
+
+// ResponseCacheStats 是响应缓存的统计
+type ResponseCacheStats struct {
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+func (rc *ResponseCache) Stats() ResponseCacheStats {
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+	return ResponseCacheStats{
+		Entries: rc.lru.Len(),
+		Size:    rc.size,
+		Hits:    rc.hits.Load(),
+		Misses:  rc.misses.Load(),
+	}
+}
+
+// Purge 删除缓存的响应, script 和 prefix 为空时删除全部, 否则只删除该脚本或请求路径以 prefix 开头的响应.
+// 返回删除的数量
+func (rc *ResponseCache) Purge(script, prefix string) int {
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+	n := 0
+	for e := rc.lru.Front(); e != nil; {
+		next := e.Next()
+		cr := e.Value.(*cachedResponse)
+		if (script == "" || cr.script == script) && (prefix == "" || strings.HasPrefix(cr.path(), prefix)) {
+			rc.remove(e)
+			n++
+		}
+		e = next
+	}
+	return n
+}
+
+func (cr *cachedResponse) path() string {
+	// base 的格式为 <module key>\n<document root>\n<host>\n<request uri>
+	uri := cr.base[strings.LastIndexByte(cr.base, '\n')+1:]
+	p, _, _ := strings.Cut(uri, "?")
+	return p
+}
+
+func (rc *ResponseCache) maxSize() int64 {
+	if rc.MaxSize > 0 {
+		return rc.MaxSize
+	}
+	return 64 << 20
+}
+
+func (rc *ResponseCache) maxEntrySize() int64 {
+	if rc.MaxEntrySize > 0 {
+		return rc.MaxEntrySize
+	}
+	return 1 << 20
+}
+
+func responseCacheBase(moduleKey string, r *http.Request, params map[string]string) string {
+	return strings.Join([]string{moduleKey, params["DOCUMENT_ROOT"], requestHost(r, params), r.URL.RequestURI()}, "\n")
+}
+
+// variantKey 将 Vary 指定的请求头加入 key
+func variantKey(base string, vary []string, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(base)
+	for _, h := range vary {
+		b.WriteString("\n")
+		b.WriteString(h)
+		b.WriteString(":")
+		b.WriteString(strings.Join(r.Header.Values(h), ","))
+	}
+	return b.String()
+}
+
+// serve 使用缓存响应请求, 未命中时返回 false
+func (rc *ResponseCache) serve(w http.ResponseWriter, r *http.Request, base string) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if cc := parseCacheControl(r.Header.Get("Cache-Control")); cc.has("no-cache") || cc.has("no-store") || cc["max-age"] == "0" {
+		return false
+	}
+	cr, body, ok := rc.lookup(r, base)
+	if !ok {
+		rc.misses.Add(1)
+		return false
+	}
+	rc.hits.Add(1)
+	h := w.Header()
+	for k, v := range cr.header {
+		h[k] = slices.Clone(v)
+	}
+	h.Set("Age", strconv.Itoa(int(time.Since(cr.storedAt).Seconds())))
+	h.Set("X-Cache", "HIT")
+	if etag := cr.header.Get("ETag"); etag != "" && etagMatch(r.Header.Get("If-None-Match"), etag) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(cr.status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+	return true
+}
+
+func (rc *ResponseCache) lookup(r *http.Request, base string) (*cachedResponse, []byte, bool) {
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+	// Vary 记录在不含 Vary 的条目上
+	e, ok := rc.entries[base]
+	if !ok {
+		return nil, nil, false
+	}
+	if vary := e.Value.(*cachedResponse).vary; len(vary) > 0 {
+		rc.lru.MoveToFront(e)
+		if e, ok = rc.entries[variantKey(base, vary, r)]; !ok {
+			return nil, nil, false
+		}
+	}
+	cr := e.Value.(*cachedResponse)
+	if time.Now().After(cr.expires) {
+		rc.remove(e)
+		return nil, nil, false
+	}
+	body := cr.body
+	if cr.file != "" {
+		b, err := os.ReadFile(cr.file)
+		if err != nil {
+			rc.remove(e)
+			return nil, nil, false
+		}
+		body = b
+	}
+	rc.lru.MoveToFront(e)
+	return cr, body, true
+}
+
+// store 在响应可以缓存时保存
+func (rc *ResponseCache) store(r *http.Request, base string, script string, rec *cacheRecorder) {
+	if r.Method != http.MethodGet || rec.overflow {
+		return
+	}
+	switch rec.status {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+	default:
+		return
+	}
+	if cc := parseCacheControl(r.Header.Get("Cache-Control")); cc.has("no-store") {
+		return
+	}
+	h := rec.header
+	if h.Get("Set-Cookie") != "" {
+		return
+	}
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	if cc.has("no-store") || cc.has("no-cache") || cc.has("private") {
+		return
+	}
+	if r.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") {
+		return
+	}
+	var ttl time.Duration
+	if v, ok := cc["s-maxage"]; ok {
+		ttl = parseSeconds(v)
+	} else if v, ok := cc["max-age"]; ok {
+		ttl = parseSeconds(v)
+	} else if exp, err := http.ParseTime(h.Get("Expires")); err == nil {
+		ttl = time.Until(exp)
+	}
+	if ttl <= 0 {
+		return
+	}
+	var vary []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name == "*" {
+				return
+			} else if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(vary)
+	vary = slices.Compact(vary)
+
+	header := h.Clone()
+	header.Del("Content-Length")
+	header.Del("X-Cache")
+	now := time.Now()
+	cr := &cachedResponse{
+		key:      variantKey(base, vary, r),
+		base:     base,
+		script:   script,
+		vary:     vary,
+		status:   rec.status,
+		header:   header,
+		body:     rec.body.Bytes(),
+		size:     int64(rec.body.Len()),
+		storedAt: now,
+		expires:  now.Add(ttl),
+	}
+	if rc.Dir != "" {
+		sum := sha256.Sum256([]byte(cr.key))
+		// 文件名带上保存时间, 避免替换旧条目时删除新文件
+		name := hex.EncodeToString(sum[:8]) + "-" + strconv.FormatInt(now.UnixNano(), 36) + ".resp"
+		file, err := writeResponseFile(rc.Dir, name, cr.body)
+		if err != nil {
+			return
+		}
+		cr.file, cr.body = file, nil
+	}
+
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+	if rc.entries == nil {
+		rc.entries = map[string]*list.Element{}
+		// 清理上次运行留下的响应文件
+		if rc.Dir != "" {
+			old, _ := filepath.Glob(filepath.Join(rc.Dir, "*.resp"))
+			for _, f := range old {
+				if f != cr.file {
+					os.Remove(f)
+				}
+			}
+		}
+	}
+	if e, ok := rc.entries[cr.key]; ok {
+		rc.remove(e)
+	}
+	if len(vary) > 0 {
+		// 在不含 Vary 的 key 上记录 Vary, 查找时才能算出完整的 key
+		if e, ok := rc.entries[base]; ok {
+			rc.remove(e)
+		}
+		marker := &cachedResponse{key: base, base: base, script: script, vary: vary, expires: cr.expires}
+		rc.entries[base] = rc.lru.PushFront(marker)
+	}
+	rc.entries[cr.key] = rc.lru.PushFront(cr)
+	rc.size += cr.size
+	for rc.size > rc.maxSize() && rc.lru.Len() > 0 {
+		rc.remove(rc.lru.Back())
+	}
+}
+
+// remove 删除条目, 调用时需持有锁
+func (rc *ResponseCache) remove(e *list.Element) {
+	cr := e.Value.(*cachedResponse)
+	rc.lru.Remove(e)
+	if cur, ok := rc.entries[cr.key]; ok && cur == e {
+		delete(rc.entries, cr.key)
+	}
+	rc.size -= cr.size
+	if cr.file != "" {
+		os.Remove(cr.file)
+	}
+}
+
+func writeResponseFile(dir, name string, b []byte) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, name+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	file := filepath.Join(dir, name)
+	return file, os.Rename(f.Name(), file)
+}
+
+// cacheRecorder 在响应客户端的同时记录响应, 超过 max 或是 event-stream 时不再记录
+type cacheRecorder struct {
+	http.ResponseWriter
+	max      int64
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+// informational 判断是否是之后还有最终响应的 1xx, 如 103 Early Hints
+func informational(code int) bool {
+	return code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+}
+
+func (rec *cacheRecorder) WriteHeader(code int) {
+	if rec.status == 0 && !informational(code) {
+		rec.status = code
+		rec.header = rec.Header().Clone()
+		if strings.HasPrefix(rec.header.Get("Content-Type"), "text/event-stream") {
+			rec.overflow = true
+		}
+		rec.Header().Set("X-Cache", "MISS")
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *cacheRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.overflow {
+		if int64(rec.body.Len()+len(b)) > rec.max {
+			rec.overflow = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *cacheRecorder) Flush() {
+	http.NewResponseController(rec.ResponseWriter).Flush()
+}
+
+func (rec *cacheRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+type cacheControl map[string]string
+
+func parseCacheControl(s string) cacheControl {
+	cc := cacheControl{}
+	for _, d := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(d), "=")
+		if k != "" {
+			cc[strings.ToLower(k)] = strings.Trim(v, `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(k string) bool {
+	_, ok := cc[k]
+	return ok
+}
+
+func parseSeconds(s string) time.Duration {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+func etagMatch(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(v), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
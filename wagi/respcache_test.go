@@ -0,0 +1,157 @@
+package wagi_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shynome/go-wagi/wagi"
+)
+
+// cacheGet 带着请求头 (成对的 key, value) 请求 guest, 忽略 1xx 响应
+func cacheGet(s *wagi.Server, url string, header ...string) *httptest.ResponseRecorder {
+	w := &hintsRecorder{ResponseRecorder: httptest.NewRecorder()}
+	r := httptest.NewRequest("GET", url, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	s.ServeParams(w, r, map[string]string{"SCRIPT_FILENAME": "guest.wasm"})
+	return w.ResponseRecorder
+}
+
+func newCacheServer(t *testing.T, rc *wagi.ResponseCache) *wagi.Server {
+	t.Helper()
+	s, _ := newGuestServer(t, wagi.WithResponseCache(rc))
+	return s
+}
+
+// assertCached 检查第二次请求是否命中缓存
+func assertCached(t *testing.T, first, second *httptest.ResponseRecorder, want bool) {
+	t.Helper()
+	hit := second.Header().Get("X-Cache") == "HIT"
+	if hit != want || (first.Body.String() == second.Body.String()) != want {
+		t.Errorf("cached %v, want %v: %q %q", hit, want, first.Body, second.Body)
+	}
+}
+
+func TestResponseCacheHit(t *testing.T) {
+	rc := &wagi.ResponseCache{}
+	s := newCacheServer(t, rc)
+	const url = "/cache/a?h=Cache-Control:max-age=60"
+	first := cacheGet(s, url)
+	if first.Code != http.StatusOK || first.Header().Get("X-Cache") == "HIT" {
+		t.Fatalf("first: %d %v", first.Code, first.Header())
+	}
+	second := cacheGet(s, url)
+	assertCached(t, first, second, true)
+	if second.Header().Get("Age") == "" {
+		t.Errorf("hit should set Age")
+	}
+	// 请求要求重新验证时不使用缓存
+	assertCached(t, first, cacheGet(s, url, "Cache-Control", "no-cache"), false)
+	// 其他路径不会命中
+	assertCached(t, first, cacheGet(s, "/cache/b?h=Cache-Control:max-age=60"), false)
+	// 缓存 1xx 之后的最终响应
+	const early = "/early?h=Cache-Control:max-age=60"
+	if w := cacheGet(s, early); w.Code != http.StatusOK || cacheGet(s, early).Header().Get("X-Cache") != "HIT" {
+		t.Errorf("response after early hints should be cached: %d", w.Code)
+	}
+	if st := rc.Stats(); st.Hits != 2 || st.Entries != 3 {
+		t.Errorf("stats: %+v", st)
+	}
+}
+
+func TestResponseCacheVary(t *testing.T) {
+	s := newCacheServer(t, &wagi.ResponseCache{})
+	const url = "/cache/?h=Cache-Control:max-age=60&h=Vary:Accept-Language"
+	en := cacheGet(s, url, "Accept-Language", "en")
+	fr := cacheGet(s, url, "Accept-Language", "fr")
+	assertCached(t, en, fr, false)
+	assertCached(t, en, cacheGet(s, url, "Accept-Language", "en"), true)
+	assertCached(t, fr, cacheGet(s, url, "Accept-Language", "fr"), true)
+}
+
+func TestResponseCacheUncacheable(t *testing.T) {
+	s := newCacheServer(t, &wagi.ResponseCache{})
+	cases := []struct {
+		name   string
+		url    string
+		header []string
+	}{
+		{"no max-age", "/cache/none", nil},
+		{"no-store", "/cache/no-store?h=Cache-Control:max-age=60,no-store", nil},
+		{"private", "/cache/private?h=Cache-Control:private,max-age=60", nil},
+		{"set-cookie", "/cache/cookie?h=Cache-Control:max-age=60&h=Set-Cookie:a=b", nil},
+		{"vary *", "/cache/vary?h=Cache-Control:max-age=60&h=Vary:*", nil},
+		{"authorization", "/cache/auth?h=Cache-Control:max-age=60", []string{"Authorization", "Bearer x"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assertCached(t, cacheGet(s, c.url, c.header...), cacheGet(s, c.url, c.header...), false)
+		})
+	}
+	// 声明了 public 时带 Authorization 的响应也可以缓存
+	const url = "/cache/public?h=Cache-Control:public,max-age=60"
+	assertCached(t, cacheGet(s, url, "Authorization", "Bearer x"), cacheGet(s, url, "Authorization", "Bearer x"), true)
+}
+
+func TestResponseCacheExpiry(t *testing.T) {
+	s := newCacheServer(t, &wagi.ResponseCache{})
+	const url = "/cache/?h=Cache-Control:max-age=1"
+	first := cacheGet(s, url)
+	assertCached(t, first, cacheGet(s, url), true)
+	time.Sleep(1100 * time.Millisecond)
+	assertCached(t, first, cacheGet(s, url), false)
+}
+
+func TestResponseCacheNotModified(t *testing.T) {
+	s := newCacheServer(t, &wagi.ResponseCache{})
+	const url = "/cache/?h=Cache-Control:max-age=60&h=ETag:%22v1%22"
+	cacheGet(s, url)
+	w := cacheGet(s, url, "If-None-Match", `"v1"`)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("matched etag: %d %v %q", w.Code, w.Header(), w.Body)
+	}
+	if w := cacheGet(s, url, "If-None-Match", `"v0"`); w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Errorf("other etag: %d %q", w.Code, w.Body)
+	}
+}
+
+func TestResponseCachePurge(t *testing.T) {
+	rc := &wagi.ResponseCache{}
+	s := newCacheServer(t, rc)
+	a, b := "/cache/a?h=Cache-Control:max-age=60", "/cache/b?h=Cache-Control:max-age=60"
+	firstA, firstB := cacheGet(s, a), cacheGet(s, b)
+	if n := rc.Purge("", "/cache/a"); n != 1 {
+		t.Errorf("purge prefix: %d, want 1", n)
+	}
+	assertCached(t, firstA, cacheGet(s, a), false)
+	assertCached(t, firstB, cacheGet(s, b), true)
+	if n := rc.Purge("other.wasm", ""); n != 0 {
+		t.Errorf("purge other script: %d, want 0", n)
+	}
+	if n := rc.Purge("guest.wasm", ""); n != 2 {
+		t.Errorf("purge script: %d, want 2", n)
+	}
+	if st := rc.Stats(); st.Entries != 0 || st.Size != 0 {
+		t.Errorf("stats after purge: %+v", st)
+	}
+}
+
+func TestResponseCacheMaxSize(t *testing.T) {
+	rc := &wagi.ResponseCache{MaxSize: 2500, MaxEntrySize: 2000}
+	s := newCacheServer(t, rc)
+	url := func(p string) string { return "/cache/" + p + "?h=Cache-Control:max-age=60&pad=1000" }
+	first := cacheGet(s, url("a"))
+	cacheGet(s, url("b"))
+	// a 最近最少使用, 保存 c 时被淘汰
+	cacheGet(s, url("c"))
+	if st := rc.Stats(); st.Entries != 2 || st.Size > rc.MaxSize {
+		t.Errorf("stats: %+v", st)
+	}
+	assertCached(t, first, cacheGet(s, url("a")), false)
+	// 超过 MaxEntrySize 的响应不会缓存
+	large := "/cache/large?h=Cache-Control:max-age=60&pad=3000"
+	assertCached(t, cacheGet(s, large), cacheGet(s, large), false)
+}
@@ -0,0 +1,175 @@
+package wagi
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Route 将请求映射到模块, 同时指定运行模块的参数
+type Route struct {
+	// Host 为空时匹配所有域名, 支持 `*.example.com` 形式的通配符
+	Host string `yaml:"host" json:"host"`
+	// Path 是路径前缀, 按路径段匹配, `/api` 匹配 `/api` 和 `/api/users` 但不匹配 `/apis`
+	Path string `yaml:"path" json:"path"`
+	// Methods 为空时匹配所有请求方法
+	Methods []string `yaml:"methods" json:"methods"`
+
+	// Module 是模块的位置, 即 SCRIPT_FILENAME, 可以是本地文件, http(s):// 或 oci://
+	Module string `yaml:"module" json:"module"`
+	// Root 是 DOCUMENT_ROOT, 会被挂载到 guest 中
+	Root string `yaml:"root" json:"root"`
+	// Env 是额外传递给 guest 的环境变量
+	Env map[string]string `yaml:"env" json:"env"`
+	// Mounts 是额外挂载的目录, 格式为 `host:guest[:ro]`
+	Mounts []string `yaml:"mounts" json:"mounts"`
+	// Net 是 WASI_NET 网络规则
+	Net string `yaml:"net" json:"net"`
+	// Mode 为 cgi 时强制以 cgi 模式运行, 为空时根据模块是否导出 wagi_wcgi 决定
+	Mode string `yaml:"mode" json:"mode"`
+	// KeepAlive 是脚本空闲多久后释放, 即 WASI_KEEPALIVE
+	KeepAlive time.Duration `yaml:"keepalive" json:"keepalive"`
+	// Pinned 为 true 时脚本常驻, 不会因空闲或预算不足被释放, 即 WASI_PINNED
+	Pinned bool `yaml:"pinned" json:"pinned"`
+	// HealthPath 是 wcgi 实例健康检查请求的路径, 即 WASI_HEALTH_PATH
+	HealthPath string `yaml:"health_path" json:"health_path"`
+	// Engine 是执行模块的方式, 即 WASI_ENGINE
+	Engine Engine `yaml:"engine" json:"engine"`
+}
+
+// Validate 检查路由配置是否正确
+func (rt *Route) Validate() error {
+	if rt.Module == "" {
+		return fmt.Errorf("route %s%s: module is required", rt.Host, rt.Path)
+	}
+	if rt.Path != "" && !strings.HasPrefix(rt.Path, "/") {
+		return fmt.Errorf("route %s%s: path must start with /", rt.Host, rt.Path)
+	}
+	switch rt.Mode {
+	case "", "cgi", "wcgi":
+	default:
+		return fmt.Errorf("route %s%s: unknown mode %q", rt.Host, rt.Path, rt.Mode)
+	}
+	if rt.Engine != "" {
+		if _, err := ParseEngine(string(rt.Engine)); err != nil {
+			return fmt.Errorf("route %s%s: %w", rt.Host, rt.Path, err)
+		}
+	}
+	return nil
+}
+
+func (rt *Route) prefix() string {
+	return strings.TrimRight(path.Clean("/"+rt.Path), "/")
+}
+
+func (rt *Route) matchHost(host string) bool {
+	switch {
+	case rt.Host == "":
+		return true
+	case strings.HasPrefix(rt.Host, "*."):
+		return strings.HasSuffix(host, rt.Host[1:])
+	default:
+		return strings.EqualFold(rt.Host, host)
+	}
+}
+
+func (rt *Route) matchPath(p string) bool {
+	prefix := rt.prefix()
+	return prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// apply 将路由的配置写入 fastcgi 参数
+func (rt *Route) apply(params map[string]string, p string) {
+	prefix := rt.prefix()
+	params["SCRIPT_FILENAME"] = rt.Module
+	params["SCRIPT_NAME"] = prefix
+	params["PATH_INFO"] = strings.TrimPrefix(p, prefix)
+	if rt.Root != "" {
+		params["DOCUMENT_ROOT"] = rt.Root
+	}
+	if len(rt.Mounts) > 0 {
+		params["WASI_MOUNTS"] = strings.Join(rt.Mounts, ",")
+	}
+	if rt.Net != "" {
+		params["WASI_NET"] = rt.Net
+	}
+	if rt.KeepAlive > 0 {
+		params["WASI_KEEPALIVE"] = rt.KeepAlive.String()
+	}
+	if rt.Pinned {
+		params["WASI_PINNED"] = "true"
+	}
+	if rt.Engine != "" {
+		params["WASI_ENGINE"] = string(rt.Engine)
+	}
+	if rt.HealthPath != "" {
+		params["WASI_HEALTH_PATH"] = rt.HealthPath
+	}
+	switch rt.Mode {
+	case "cgi":
+		params["WASI_CGI"] = "true"
+	case "wcgi":
+		delete(params, "WASI_CGI")
+	}
+	for k, v := range rt.Env {
+		params[k] = v
+	}
+	addInstanceKey(params, "route:"+rt.Host+rt.prefix(), rt.Env)
+}
+
+// RouteTable 按域名, 请求方法和最长路径前缀匹配路由, 再交给 Next 加载路由指定的模块
+//
+// 同样长度的前缀中, 指定了 Host 的路由优先
+type RouteTable struct {
+	Routes []Route
+	// Next 用于加载 Route.Module, 为 nil 时使用 [LocalResolver]
+	Next Resolver
+}
+
+var _ Resolver = (*RouteTable)(nil)
+
+// Match 返回请求匹配的路由, 没有匹配时返回 nil
+func (t *RouteTable) Match(r *http.Request) *Route {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	p := path.Clean("/" + r.URL.Path)
+	var best *Route
+	for i := range t.Routes {
+		rt := &t.Routes[i]
+		if !rt.matchHost(host) || !rt.matchPath(p) {
+			continue
+		}
+		if len(rt.Methods) > 0 && !slices.ContainsFunc(rt.Methods, func(m string) bool {
+			return strings.EqualFold(m, r.Method)
+		}) {
+			continue
+		}
+		if best == nil {
+			best = rt
+			continue
+		}
+		if l, bl := len(rt.prefix()), len(best.prefix()); l > bl || (l == bl && best.Host == "" && rt.Host != "") {
+			best = rt
+		}
+	}
+	return best
+}
+
+func (t *RouteTable) Resolve(r *http.Request, params map[string]string) (*Script, error) {
+	rt := t.Match(r)
+	if rt == nil {
+		return nil, fmt.Errorf("%w: no route for %s %s%s", ErrScriptNotFound, r.Method, r.Host, r.URL.Path)
+	}
+	rt.apply(params, path.Clean("/"+r.URL.Path))
+	next := t.Next
+	if next == nil {
+		next = LocalResolver{}
+	}
+	return next.Resolve(r, params)
+}
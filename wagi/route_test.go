@@ -0,0 +1,87 @@
+package wagi_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shynome/go-wagi/wagi"
+)
+
+func TestRouteTable(t *testing.T) {
+	table := &wagi.RouteTable{Routes: []wagi.Route{
+		{Path: "/", Module: "index"},
+		{Path: "/api", Module: "api"},
+		{Path: "/api/admin", Module: "admin", Methods: []string{"POST"}},
+		{Path: "/api", Host: "*.example.com", Module: "tenant-api"},
+		{Path: "/", Host: "static.example.com", Module: "static", Mode: "cgi"},
+	}}
+	cases := []struct {
+		method, url, module, scriptName, pathInfo string
+	}{
+		{"GET", "http://localhost/", "index", "", "/"},
+		{"GET", "http://localhost/apis", "index", "", "/apis"},
+		{"GET", "http://localhost/api", "api", "/api", ""},
+		{"GET", "http://localhost/api/users/1", "api", "/api", "/users/1"},
+		{"GET", "http://localhost/api/admin", "api", "/api", "/admin"},
+		{"POST", "http://localhost/api/admin/x", "admin", "/api/admin", "/x"},
+		{"GET", "http://a.example.com:8080/api/x", "tenant-api", "/api", "/x"},
+		{"GET", "http://static.example.com/a.css", "static", "", "/a.css"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.url, nil)
+		params := map[string]string{}
+		// Next 直接返回路由写入的参数
+		table.Next = wagi.ResolverFunc(func(r *http.Request, params map[string]string) (*wagi.Script, error) {
+			return &wagi.Script{Name: params["SCRIPT_FILENAME"]}, nil
+		})
+		sc, err := table.Resolve(r, params)
+		if err != nil {
+			t.Errorf("%s %s: %v", c.method, c.url, err)
+			continue
+		}
+		if sc.Name != c.module {
+			t.Errorf("%s %s: module %s, want %s", c.method, c.url, sc.Name, c.module)
+		}
+		if params["SCRIPT_NAME"] != c.scriptName || params["PATH_INFO"] != c.pathInfo {
+			t.Errorf("%s %s: SCRIPT_NAME %q PATH_INFO %q", c.method, c.url, params["SCRIPT_NAME"], params["PATH_INFO"])
+		}
+	}
+
+	r := httptest.NewRequest("GET", "http://static.example.com/", nil)
+	params := map[string]string{}
+	table.Resolve(r, params)
+	if params["WASI_CGI"] != "true" {
+		t.Error("mode cgi should set WASI_CGI")
+	}
+
+	empty := &wagi.RouteTable{Routes: []wagi.Route{{Path: "/api", Module: "api"}}}
+	if _, err := empty.Resolve(httptest.NewRequest("GET", "/", nil), map[string]string{}); err == nil {
+		t.Error("should not match any route")
+	}
+}
+
+func TestRouteTableIsolateInstances(t *testing.T) {
+	module := filepath.Join(t.TempDir(), "guest.wasm")
+	if err := os.WriteFile(module, guestModule(t), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// 两个路由使用同一个模块, 环境变量不同
+	s, _ := newGuestServer(t, wagi.WithResolver(&wagi.RouteTable{
+		Routes: []wagi.Route{
+			{Path: "/a", Module: module, Env: map[string]string{"TENANT": "a"}},
+			{Path: "/b", Module: module, Env: map[string]string{"TENANT": "b"}},
+		},
+		Next: wagi.LocalResolver{},
+	}))
+	for range 2 {
+		for _, tenant := range []string{"a", "b"} {
+			w := do(s, "GET", "/"+tenant+"?k=TENANT")
+			if w.Code != http.StatusOK || w.Body.String() != tenant {
+				t.Fatalf("%s: %d %q", tenant, w.Code, w.Body.String())
+			}
+		}
+	}
+}
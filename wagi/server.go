@@ -0,0 +1,638 @@
+package wagi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/shynome/err0"
+	"github.com/shynome/err0/try"
+	"github.com/shynome/go-wagi/cgi"
+	"github.com/shynome/go-wagi/fsnet"
+	"github.com/shynome/wcgi"
+	"github.com/tetratelabs/wazero"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServeParams 使用指定的 fastcgi 参数处理请求, params 会被修改
+func (s *Server) ServeParams(w http.ResponseWriter, r *http.Request, env map[string]string) {
+	if s.compression != nil {
+		cw := s.compression.wrap(w, r)
+		defer cw.Close()
+		w = cw
+	}
+	s.serveParams(w, r, env)
+}
+
+func (s *Server) serveParams(w http.ResponseWriter, r *http.Request, env map[string]string) {
+	var err error
+	defer err0.Then(&err, nil, func() {
+		if errors.Is(err, ErrScriptNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, ErrBudgetExhausted) {
+			s.logger.Warn("reject request", "script", env["SCRIPT_FILENAME"], "err", err)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if errors.Is(err, ErrGuestTrapped) {
+			// trap 的详情只写入日志
+			s.logger.Error("serve failed", "script", env["SCRIPT_FILENAME"], "err", err)
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		s.logger.Error("serve failed", "script", env["SCRIPT_FILENAME"], "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	})
+
+	s.policy.apply(env)
+	if vh := s.virtualHost(r, env); vh != nil {
+		vh.apply(env)
+		var ok bool
+		var cancel context.CancelFunc
+		if r, cancel, ok = vh.Limits.limit(w, r); !ok {
+			return
+		}
+		defer cancel()
+	}
+	sc, rerr := s.resolver.Resolve(r, env)
+	// 静态文件在查找模块时设置的 DOCUMENT_ROOT 中查找, 没有对应的模块时也会查找
+	if s.static && (rerr == nil || errors.Is(rerr, ErrScriptNotFound)) && serveStatic(w, r, env["DOCUMENT_ROOT"]) {
+		return
+	}
+	try.To(rerr)
+	script := sc.Name
+	env["SCRIPT_FILENAME"] = script
+	cwd := env["DOCUMENT_ROOT"]
+
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "fastcgi.request",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("wagi.script", script),
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+		),
+	)
+	defer span.End()
+	defer err0.Then(&err, nil, func() {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	})
+	r = r.WithContext(ctx)
+
+	if rc := s.respCache; rc != nil {
+		base := responseCacheBase(sc.Key, r, env)
+		if rc.serve(w, r, base) {
+			span.SetAttributes(attribute.Bool("wagi.cache_hit", true))
+			return
+		}
+		rec := &cacheRecorder{ResponseWriter: w, max: rc.maxEntrySize()}
+		w = rec
+		defer rc.store(r, base, script, rec)
+	}
+
+	release, ok := s.limiters.limit(w, r, script, env)
+	if !ok {
+		span.SetAttributes(attribute.Bool("wagi.limited", true))
+		return
+	}
+	defer release()
+
+	// 站点和路由的配置不同时使用不同的实例
+	instKey := env[instanceParam]
+	delete(env, instanceParam)
+	fileKey := "file-" + script
+	if instKey != "" {
+		fileKey += "#" + instKey
+	}
+	wasmKey := sc.Key
+	engine := s.engineOf(script, env)
+	if engine != s.engine {
+		wasmKey += "@" + string(engine)
+	}
+	netRule := env["WASI_NET"]
+	mounts := env["WASI_MOUNTS"]
+	proxyKey := strings.Join([]string{wasmKey, cwd, netRule, mounts, instKey}, ",")
+
+	keepAlive, pinned := s.keepAliveOf(script, env)
+	inst := s.instCache.Get(fileKey)
+	if inst == nil {
+		func() {
+			s.instCache.mux.Lock()
+			defer s.instCache.mux.Unlock()
+			ctx := context.Background()
+			ctx, cancel := context.WithCancel(ctx)
+			timer := time.AfterFunc(keepAlive, func() {
+				cancel()
+			})
+			go func() {
+				<-ctx.Done()
+				s.instCache.Del(fileKey)
+			}()
+			inst = &InstanceItem{
+				Script:   script,
+				Instance: instKey,
+				WasmKey:  wasmKey,
+				ProxyKey: proxyKey,
+				timer:    timer,
+				ctx:      ctx,
+				cancel:   cancel,
+			}
+		}()
+		s.instCache.Set(fileKey, inst)
+	}
+	inst.keepAlive.Store(int64(keepAlive))
+	inst.pinned.Store(pinned)
+	if pinned {
+		inst.timer.Stop()
+	} else {
+		inst.timer.Reset(keepAlive)
+	}
+	inst.lastUsed.Store(time.Now().UnixNano())
+
+	wasmGet := s.mCache.Get(wasmKey)
+	func() {
+		s.instCache.mux.RLock()
+		defer s.instCache.mux.RUnlock()
+		inst.keys.Lock()
+		defer inst.keys.Unlock()
+
+		// clear old wasm module
+		func() {
+			if inst.WasmKey == wasmKey {
+				return
+			}
+			wasmGet := s.mCache.Get(inst.WasmKey)
+			if wasmGet == nil {
+				return
+			}
+			s.mCache.Del(inst.WasmKey)
+			// 正在使用旧模块的请求和实例结束后才关闭
+			if mod, err := wasmGet(); err == nil && mod.retired.CompareAndSwap(false, true) {
+				mod.release()
+			}
+		}()
+		// clear old proxy instance
+		func() {
+			if inst.ProxyKey == proxyKey {
+				return
+			}
+			proxyGet := s.proxyCache.Get(inst.ProxyKey)
+			if proxyGet == nil {
+				return
+			}
+			if proxy, err := proxyGet(); err == nil {
+				proxy.Close()
+			}
+			s.proxyCache.Del(inst.ProxyKey)
+		}()
+		inst.WasmKey = wasmKey
+		inst.ProxyKey = proxyKey
+	}()
+
+	if wasmGet == nil {
+		wasmGet = sync.OnceValues(func() (*WasmItem, error) {
+			_, span := tracer.Start(r.Context(), "wasm.compile")
+			defer span.End()
+			ctx := inst.ctx
+			binary, err := sc.Load(ctx)
+			if err != nil {
+				span.RecordError(err)
+				return nil, err
+			}
+			size := len(binary)
+			// 导出全局变量, 以便 cgi 模式下从快照启动
+			var globals []string
+			if s.snapshots {
+				if bin, names, err := exportGlobals(binary, SnapshotInit); err != nil {
+					s.logger.Warn("snapshot is disabled", "script", script, "err", err)
+				} else if bin != nil {
+					binary, globals = bin, names
+				}
+			}
+			var wasm *WasmItem
+			if engine == EngineAuto {
+				wasm, err = s.compileAuto(ctx, wasmKey, script, binary, size, globals)
+			} else {
+				wasm, err = s.compileWasm(ctx, engine, wasmKey, script, binary, size, globals)
+			}
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				return nil, err
+			}
+			s.mCache.SetCost(wasmKey, int64(size))
+			return wasm, nil
+		})
+		s.mCache.Set(wasmKey, wasmGet)
+	}
+	var wasm *WasmItem
+	for {
+		if wasm, err = wasmGet(); err != nil {
+			s.mCache.Del(wasmKey)
+			return
+		}
+		if wasm.acquire() {
+			break
+		}
+		// 解释执行的模块刚被替换并释放, 缓存中已经是编译后的模块
+		if wasmGet = s.mCache.Get(wasmKey); wasmGet == nil {
+			try.To(fmt.Errorf("module of %s was released", script))
+		}
+	}
+	defer wasm.release()
+	inst.wasm.Store(wasm)
+
+	// 强制以 CGI 模式运行
+	forceCGI := env["WASI_CGI"] == "true"
+	if forceCGI || !wasm.SupportWCGI {
+		envList := []string{}
+		for k, v := range env {
+			envList = append(envList, k+"="+v)
+		}
+
+		done := try.To1(s.admit(true, initialMemory(wasm.CompiledModule)))
+		defer done()
+
+		stderr := s.stderr.Writer(script, "request_id", requestID(env))
+		defer stderr.Close()
+
+		h := cgi.Handler{
+			Path:   script,
+			Args:   []string{"wcgi"},
+			Env:    envList,
+			Dir:    cwd,
+			Stderr: stderr,
+			Logger: slog.NewLogLogger(s.logger.Handler(), slog.LevelError),
+
+			Runtime: wasm.runtime,
+			WASM:    wasm.CompiledModule,
+		}
+		if wasm.snapshot != nil && env["WASI_SNAPSHOT"] != "false" {
+			if snap, err := wasm.snapshot(); err == nil {
+				h.Restore = snap.restore
+			}
+		}
+		s.guests.Add(1)
+		defer s.guests.Done()
+		h.ServeHTTP(w, r)
+		return
+	}
+
+	getProxy := func() (*ProxyItem, error) {
+		proxyGet := s.proxyCache.Get(proxyKey)
+		if proxyGet != nil {
+			// 已退出的实例可能还没有从缓存中删除
+			if proxy, err := proxyGet(); err == nil && proxy.Closed() {
+				s.dropProxy(proxy)
+				proxyGet = nil
+			}
+		}
+		if proxyGet == nil {
+			proxyGet = sync.OnceValues(func() (_ *ProxyItem, err error) {
+				_, span := tracer.Start(r.Context(), "wcgi.instantiate")
+				defer span.End()
+
+				ctx := inst.ctx
+				ctx, cancel := context.WithCancel(ctx)
+
+				defer err0.Then(&err, nil, func() {
+					span.RecordError(err)
+					span.SetStatus(codes.Error, err.Error())
+					cancel()
+				})
+
+				// 实例持有模块的引用直到退出, 后台重启实例时请求的引用可能已经释放
+				if !wasm.acquire() {
+					try.To(fmt.Errorf("module of %s was released", script))
+				}
+				proxy := &ProxyItem{
+					Key:   proxyKey,
+					Close: cancel,
+					ctx:   ctx,
+					inst:  inst,
+					wasm:  wasm,
+				}
+				go func() {
+					<-ctx.Done()
+					s.dropProxy(proxy)
+					s.proxies.CompareAndDelete(proxyKey, proxy)
+					wasm.release()
+				}()
+
+				// 实例存入 inst 后按实际内存计算预算
+				done := try.To1(s.admit(false, initialMemory(wasm.CompiledModule)))
+				defer done()
+
+				stdio := &wcgi.Stdio{}
+				var (
+					stdin  io.Reader
+					stdout io.Writer
+				)
+				stdin, stdio.Writer = try.To2(os.Pipe())
+				stdio.Reader, stdout = try.To2(os.Pipe())
+
+				mc := wazero.NewModuleConfig()
+				mc = cgi.WithCommonConfig(mc)
+				fsc := wazero.NewFSConfig()
+				if cwd != "" {
+					fsc = fsc.WithDirMount(cwd, cwd)
+				}
+				fsc = cgi.WithMounts(fsc, mounts)
+				if netRule != "" {
+					fsc = fsc.WithFSMount(fsnet.New(netRule), "/dev")
+				}
+				mc = mc.WithFSConfig(fsc)
+				env["WAGI_WCGI"] = "true"
+				for k, v := range env {
+					mc = mc.WithEnv(k, v)
+				}
+				// wcgi 模式下多个请求共用一个实例, stderr 只能标记到实例
+				stderr := s.stderr.Writer(script, "instance", requestID(nil))
+				go func() {
+					<-ctx.Done()
+					stderr.Close()
+				}()
+				mc = mc.WithStderr(stderr)
+				mc = mc.WithStdin(stdin).WithStdout(stdout)
+
+				proxy.StartedAt = time.Now()
+				proxy.lastUsed.Store(proxy.StartedAt.UnixNano())
+
+				s.guests.Add(1)
+				go func() {
+					defer s.guests.Done()
+					defer cancel()
+					// 手动调用 _start, 以便在调用前记录初始的内存大小
+					gctx := withMemoryRecorder(ctx, &proxy.memory)
+					mc := mc.WithName("").WithStartFunctions()
+					mod, err := wasm.runtime.InstantiateModule(gctx, wasm.CompiledModule, mc)
+					if err == nil {
+						defer mod.Close(ctx)
+						if mem := mod.Memory(); mem != nil {
+							proxy.memory.Store(int64(mem.Size()))
+						}
+						if start := mod.ExportedFunction("_start"); start != nil {
+							_, err = start.Call(gctx)
+						}
+					}
+					// 在关闭 yamux 前记录, 使失败的请求能看到 trap, 并立即让后续请求启动新的实例
+					if trap := trapError(ctx, err); trap != nil {
+						s.logger.Error("wcgi instance trapped", "script", script, "err", trap)
+						proxy.trap.Store(&trap)
+						s.dropProxy(proxy)
+					}
+				}()
+
+				yc := yamux.DefaultConfig()
+				yc.KeepAliveInterval = 10 * time.Second
+				yc.StreamCloseTimeout = 5 * time.Second
+				yc.StreamOpenTimeout = 5 * time.Second
+				sess := try.To1(yamux.Client(stdio, yc))
+				if _, perr := sess.Ping(); perr != nil {
+					if trap := proxy.Trap(); trap != nil {
+						perr = trap
+					}
+					try.To(fmt.Errorf("wcgi instance failed to start: %w", perr))
+				}
+				go func() {
+					<-sess.CloseChan()
+					cancel()
+				}()
+				go func() {
+					<-ctx.Done()
+					sess.Close()
+				}()
+
+				endpoint := fmt.Sprintf("http://yamux.proxy/")
+				target := try.To1(url.Parse(endpoint))
+				handler := httputil.NewSingleHostReverseProxy(target)
+				handler.Transport = &http.Transport{
+					DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+						conn, err := sess.Open()
+						return conn, err
+					},
+				}
+				// 请求 guest 失败时交给 serveProxy 决定是否重试
+				handler.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+					if perr, ok := r.Context().Value(proxyErrorKey{}).(*error); ok {
+						*perr = err
+						return
+					}
+					w.WriteHeader(http.StatusBadGateway)
+				}
+				go http.Serve(sess, handler)
+
+				proxy.Handler = handler
+				proxy.StartupTime = time.Since(proxy.StartedAt)
+				if s.health.Interval > 0 {
+					client := &http.Client{Transport: handler.Transport}
+					go s.watchHealth(ctx, script, proxy, sess, client, env["WASI_HEALTH_PATH"])
+				}
+				inst.proxy.Store(proxy)
+				s.proxies.Store(proxyKey, proxy)
+				// 在释放预留的预算前记录, 避免实例短暂地不计入预算
+				s.track(proxy)
+				return proxy, nil
+			})
+			s.proxyCache.Set(proxyKey, proxyGet)
+		}
+		proxy, err := proxyGet()
+		if err != nil {
+			s.proxyCache.Del(proxyKey)
+		}
+		return proxy, err
+	}
+
+	// 实例异常时换一个新的实例重试一次幂等的请求
+	for attempt := 0; ; attempt++ {
+		proxy := try.To1(getProxy())
+		inst.proxy.Store(proxy)
+		perr := s.serveProxy(ctx, w, r, proxy)
+		if perr == nil {
+			s.recycleProxy(script, proxy, getProxy)
+			return
+		}
+		if r.Context().Err() != nil {
+			return
+		}
+		retry := retryable(r)
+		if trap := proxy.Trap(); trap != nil {
+			// trap 可能是请求本身导致的, 只重试安全的请求
+			perr = trap
+			retry = r.Method == http.MethodGet || r.Method == http.MethodHead
+		}
+		s.logger.Warn("wcgi instance failed", "script", script, "err", perr, "attempt", attempt)
+		proxy.Close()
+		s.dropProxy(proxy)
+		if attempt > 0 || !retry {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+	}
+}
+
+type proxyErrorKey struct{}
+
+// serveProxy 将请求转发给 wcgi 实例, 返回请求 guest 时的错误, 出错时还没有写入响应
+func (s *Server) serveProxy(ctx context.Context, w http.ResponseWriter, r *http.Request, proxy *ProxyItem) error {
+	proxy.requests.Add(1)
+	proxy.lastUsed.Store(time.Now().UnixNano())
+	proxy.active.Add(1)
+	defer proxy.active.Add(-1)
+
+	pctx, pspan := tracer.Start(ctx, "wcgi.proxy", trace.WithSpanKind(trace.SpanKindClient))
+	defer pspan.End()
+	var perr error
+	// 透传 traceparent, 使 guest 中的 span 加入该 trace
+	r = r.Clone(context.WithValue(pctx, proxyErrorKey{}, &perr))
+	otel.GetTextMapPropagator().Inject(pctx, propagation.HeaderCarrier(r.Header))
+	proxy.ServeHTTP(w, r)
+	if perr != nil {
+		pspan.RecordError(perr)
+		pspan.SetStatus(codes.Error, perr.Error())
+	}
+	return perr
+}
+
+// retryable 判断请求是否可以重试, 只重试没有请求体的幂等请求
+func retryable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0
+}
+
+// keepAliveOf 按 WASI_KEEPALIVE 和 WASI_PINNED 参数返回脚本的空闲时间和是否常驻
+func (s *Server) keepAliveOf(script string, env map[string]string) (keepAlive time.Duration, pinned bool) {
+	keepAlive = s.keepAlive
+	if v := env["WASI_KEEPALIVE"]; v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			keepAlive = d
+		} else {
+			s.logger.Warn("invalid WASI_KEEPALIVE", "script", script, "value", v)
+		}
+	}
+	if v := env["WASI_PINNED"]; v != "" {
+		var err error
+		if pinned, err = strconv.ParseBool(v); err != nil {
+			s.logger.Warn("invalid WASI_PINNED", "script", script, "value", v)
+		}
+	}
+	return
+}
+
+// SupportWCGI 判断模块是否导出了 wagi_wcgi 函数, 导出时以 wcgi 模式运行
+func SupportWCGI(mod wazero.CompiledModule) bool {
+	_, ok := mod.ExportedFunctions()["wagi_wcgi"]
+	return ok
+}
+
+type InstanceItem struct {
+	Script   string
+	Instance string // 站点和路由的标识, 见 addInstanceKey
+	WasmKey  string // 读写时需要持有 keys
+	ProxyKey string
+	keys     sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	timer    *time.Timer
+
+	keepAlive atomic.Int64 // 空闲多久后释放
+	pinned    atomic.Bool  // 常驻, 不会因空闲被释放
+
+	lastUsed atomic.Int64
+	wasm     atomic.Pointer[WasmItem]
+	proxy    atomic.Pointer[ProxyItem]
+}
+
+// Close 释放该脚本的 wasm 模块和 wcgi 实例
+func (inst *InstanceItem) Close() {
+	inst.timer.Stop()
+	inst.cancel()
+}
+
+func (inst *InstanceItem) LastUsed() time.Time {
+	return time.Unix(0, inst.lastUsed.Load())
+}
+
+type WasmItem struct {
+	wazero.CompiledModule
+	Key         string
+	Size        int // wasm 文件的大小
+	Engine      Engine
+	SupportWCGI bool
+	CompiledAt  time.Time
+	CompileTime time.Duration
+	Close       func()
+
+	snapshot func() (*snapshot, error) // 模块导出了 SnapshotInit 时不为空
+	ctx      context.Context
+	runtime  wazero.Runtime
+	retired  atomic.Bool  // 已被编译后的模块替换或从缓存中淘汰
+	refs     atomic.Int64 // 缓存, 正在使用模块的请求和 wcgi 实例各持有一个引用
+}
+
+type ProxyItem struct {
+	http.Handler
+	Key         string
+	StartedAt   time.Time
+	StartupTime time.Duration // 实例化到 yamux 握手完成的耗时
+	Close       func()
+
+	ctx      context.Context
+	memory   atomic.Int64 // guest 最近一次调用 WASI 时的线性内存字节数, 见 withMemoryRecorder
+	requests atomic.Int64
+	active   atomic.Int64 // 正在处理的请求数
+	lastUsed atomic.Int64
+	health   healthState
+	trap     atomic.Pointer[error]
+	retired  atomic.Bool // 已从缓存中移除
+	inst     *InstanceItem
+	wasm     *WasmItem
+}
+
+// busy 表示实例常驻或正在处理请求, 不会因缓存容量被淘汰
+func (p *ProxyItem) busy() bool {
+	return !p.Closed() && (p.active.Load() > 0 || p.inst.pinned.Load())
+}
+
+// dropProxy 将实例从缓存中移除, 每个实例只移除一次, 避免误删同一个 key 下新启动的实例
+func (s *Server) dropProxy(proxy *ProxyItem) bool {
+	if !proxy.retired.CompareAndSwap(false, true) {
+		return false
+	}
+	s.proxyCache.Del(proxy.Key)
+	return true
+}
+
+func (p *ProxyItem) Closed() bool {
+	return p.ctx.Err() != nil
+}
+
+// MemoryPages 返回 guest 最近一次调用 WASI 时线性内存的页数, 实例未启动时为 0
+func (p *ProxyItem) MemoryPages() uint32 {
+	return uint32(p.memory.Load() / 65536)
+}
@@ -0,0 +1,107 @@
+package wagi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/shynome/go-wagi/cgi"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// SnapshotInit 是快照的初始化函数, 与 Wizer 相同.
+// 模块导出了该函数时, cgi 模式下只在第一次运行时调用它, 之后的实例从调用后的内存和全局变量启动
+const SnapshotInit = "wizer.initialize"
+
+const pageSize = 65536
+
+// snapshot 是调用初始化函数后的线性内存和全局变量
+type snapshot struct {
+	pages   uint32
+	dirty   []memoryRange // 与刚实例化时不同的内存
+	globals map[string]uint64
+	took    time.Duration
+}
+
+type memoryRange struct {
+	offset uint32
+	data   []byte
+}
+
+// takeSnapshot 实例化模块并调用初始化函数, 初始化时没有环境变量, 参数和文件系统
+func takeSnapshot(ctx context.Context, rt wazero.Runtime, mod wazero.CompiledModule, globals []string) (_ *snapshot, err error) {
+	start := time.Now()
+	mc := cgi.WithCommonConfig(wazero.NewModuleConfig()).WithName("").WithStartFunctions()
+	m, err := rt.InstantiateModule(ctx, mod, mc)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close(ctx)
+
+	var initial []byte
+	mem := m.Memory()
+	if mem != nil {
+		b, _ := mem.Read(0, mem.Size())
+		initial = bytes.Clone(b)
+	}
+	if _, err := m.ExportedFunction(SnapshotInit).Call(ctx); err != nil {
+		return nil, fmt.Errorf("call %s: %w", SnapshotInit, err)
+	}
+
+	snap := &snapshot{globals: map[string]uint64{}}
+	for _, name := range globals {
+		snap.globals[name] = m.ExportedGlobal(name).Get()
+	}
+	if mem != nil {
+		b, _ := mem.Read(0, mem.Size())
+		snap.pages = mem.Size() / pageSize
+		snap.dirty = diffPages(initial, b)
+	}
+	snap.took = time.Since(start)
+	return snap, nil
+}
+
+// diffPages 按页比较内存, 返回 after 中与 before 不同的连续区域
+func diffPages(before, after []byte) []memoryRange {
+	var ranges []memoryRange
+	for off := 0; off < len(after); off += pageSize {
+		end := min(off+pageSize, len(after))
+		page := after[off:end]
+		if off < len(before) && bytes.Equal(page, before[off:min(end, len(before))]) {
+			continue
+		}
+		if n := len(ranges); n > 0 && int(ranges[n-1].offset)+len(ranges[n-1].data) == off {
+			ranges[n-1].data = append(ranges[n-1].data, page...)
+			continue
+		}
+		ranges = append(ranges, memoryRange{offset: uint32(off), data: bytes.Clone(page)})
+	}
+	return ranges
+}
+
+// restore 将快照写入刚实例化的模块
+func (snap *snapshot) restore(ctx context.Context, m api.Module) error {
+	if snap.pages > 0 {
+		mem := m.Memory()
+		if size := mem.Size() / pageSize; size < snap.pages {
+			if _, ok := mem.Grow(snap.pages - size); !ok {
+				return fmt.Errorf("grow memory to %d pages failed", snap.pages)
+			}
+		}
+		for _, r := range snap.dirty {
+			if !mem.Write(r.offset, r.data) {
+				return fmt.Errorf("write memory at %d failed", r.offset)
+			}
+		}
+	}
+	for name, v := range snap.globals {
+		g, ok := m.ExportedGlobal(name).(api.MutableGlobal)
+		if !ok {
+			return fmt.Errorf("global %s is not mutable", name)
+		}
+		g.Set(v)
+	}
+	return nil
+}
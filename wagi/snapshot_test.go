@@ -0,0 +1,94 @@
+package wagi_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shynome/go-wagi/wagi"
+)
+
+// snapshotModule 输出 "N", 调用 wizer.initialize 后输出 "Y".
+// 初始化同时修改了内存和未导出的全局变量 (输出的长度), 恢复不完整时没有输出
+func snapshotModule() []byte {
+	leb := func(n int) []byte {
+		var b []byte
+		for {
+			c := byte(n & 0x7f)
+			n >>= 7
+			if n == 0 {
+				return append(b, c)
+			}
+			b = append(b, c|0x80)
+		}
+	}
+	name := func(s string) []byte { return append(leb(len(s)), s...) }
+	section := func(id byte, parts ...[]byte) []byte {
+		var payload []byte
+		for _, p := range parts {
+			payload = append(payload, p...)
+		}
+		return append(append([]byte{id}, leb(len(payload))...), payload...)
+	}
+	body := func(code ...byte) []byte { return append(leb(len(code)+1), append([]byte{0}, code...)...) }
+	output := "Content-Type: text/plain\n\nN"
+
+	var m []byte
+	m = append(m, 0, 'a', 's', 'm', 1, 0, 0, 0)
+	m = append(m, section(1, []byte{2, 0x60, 0, 0, 0x60, 4, 0x7f, 0x7f, 0x7f, 0x7f, 1, 0x7f})...)
+	m = append(m, section(2, []byte{1}, name("wasi_snapshot_preview1"), name("fd_write"), []byte{0, 1})...)
+	m = append(m, section(3, []byte{2, 0, 0})...)
+	m = append(m, section(5, []byte{1, 0, 1})...)
+	m = append(m, section(6, []byte{1, 0x7f, 1, 0x41, 0, 0x0b})...)
+	m = append(m, section(7, []byte{3},
+		name("wizer.initialize"), []byte{0, 1},
+		name("_start"), []byte{0, 2},
+		name("memory"), []byte{2, 0},
+	)...)
+	m = append(m, section(10, []byte{2},
+		// 把输出改为 Y, 并设置输出的长度
+		body(0x41, 0xfe, 0x00, 0x41, 'Y'|0x80, 0, 0x3a, 0, 0, 0x41, byte(len(output)), 0x24, 0, 0x0b),
+		// fd_write(1, iovec{100, global 0}, 1, 200)
+		body(0x41, 0, 0x41, 0xe4, 0, 0x36, 2, 0, 0x41, 4, 0x23, 0, 0x36, 2, 0,
+			0x41, 1, 0x41, 0, 0x41, 1, 0x41, 0xc8, 1, 0x10, 0, 0x1a, 0x0b),
+	)...)
+	m = append(m, section(11, []byte{1, 0, 0x41, 0xe4, 0, 0x0b}, name(output))...)
+	return m
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	res := wagi.ResolverFunc(func(r *http.Request, params map[string]string) (*wagi.Script, error) {
+		return &wagi.Script{
+			Name: "snapshot.wasm",
+			Key:  "snapshot",
+			Load: func(ctx context.Context) ([]byte, error) { return snapshotModule(), nil },
+		}, nil
+	})
+	for _, tc := range []struct {
+		snapshots bool
+		want      string
+	}{
+		{true, "Y"},
+		{false, ""},
+	} {
+		opts := []wagi.Option{wagi.WithResolver(res), wagi.WithParams(wagi.EmptyParams)}
+		if tc.snapshots {
+			opts = append(opts, wagi.WithSnapshots())
+		}
+		s, err := wagi.New(ctx, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 每个请求都从快照启动
+		for range 2 {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			if got := w.Body.String(); got != tc.want {
+				t.Errorf("snapshots %v: got %q, want %q", tc.snapshots, got, tc.want)
+			}
+		}
+		s.Close(ctx)
+	}
+}
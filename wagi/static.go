@@ -0,0 +1,74 @@
+package wagi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// serveStatic 响应 root 中的静态文件, 文件不存在, 不是静态文件或通过符号链接指向 root 之外时返回 false
+func serveStatic(w http.ResponseWriter, r *http.Request, root string) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead || root == "" {
+		return false
+	}
+	p := path.Clean("/" + r.URL.Path)
+	if hidden(p) {
+		return false
+	}
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false
+	}
+	name, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(p)))
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || hidden(filepath.ToSlash(rel)) {
+		return false
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	finfo, err := f.Stat()
+	if err != nil || !finfo.Mode().IsRegular() {
+		return false
+	}
+	if isWasm(f) {
+		return false
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, finfo.ModTime().UnixNano(), finfo.Size()))
+	http.ServeContent(w, r, finfo.Name(), finfo.ModTime(), f)
+	return true
+}
+
+// hidden 判断路径中是否有以 . 开头的部分
+func hidden(p string) bool {
+	for _, seg := range strings.Split(p, "/") {
+		if strings.HasPrefix(seg, ".") && seg != "." {
+			return true
+		}
+	}
+	return false
+}
+
+var wasmMagic = []byte("\x00asm")
+
+// isWasm 根据文件头判断是否是 wasm 模块, 模块的文件名不一定以 .wasm 结尾
+func isWasm(r io.Reader) bool {
+	b := make([]byte, len(wasmMagic))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return false
+	}
+	return bytes.Equal(b, wasmMagic)
+}
@@ -0,0 +1,129 @@
+package wagi_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shynome/go-wagi/wagi"
+)
+
+func TestStaticFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.css":     "body{}",
+		"index.php": "\x00asm\x01\x00\x00\x00",
+		".env":      "SECRET=1",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 没有静态文件时交给模块, 这里以 404 代替
+	res := wagi.ResolverFunc(func(r *http.Request, params map[string]string) (*wagi.Script, error) {
+		return nil, fmt.Errorf("%w: module", wagi.ErrScriptNotFound)
+	})
+	ctx := context.Background()
+	s, err := wagi.New(ctx,
+		wagi.WithResolver(res),
+		wagi.WithParams(wagi.ScriptParams(filepath.Join(dir, "index.php"), dir)),
+		wagi.WithStaticFiles(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(ctx)
+
+	serve := func(method, p string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, p, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("GET", "/a.css")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || w.Body.String() != "body{}" || etag == "" || w.Header().Get("Last-Modified") == "" {
+		t.Fatalf("GET /a.css: %d %q etag %q", w.Code, w.Body.String(), etag)
+	}
+	if w := serve("GET", "/a.css", "If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: %d", w.Code)
+	}
+	if w := serve("GET", "/a.css", "Range", "bytes=0-3"); w.Code != http.StatusPartialContent || w.Body.String() != "body" {
+		t.Errorf("Range: %d %q", w.Code, w.Body.String())
+	}
+	for _, p := range []string{"/index.php", "/.env", "/missing.js", "/"} {
+		if w := serve("GET", p); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s should fall back to the module: %d", p, w.Code)
+		}
+	}
+	if w := serve("POST", "/a.css"); w.Code != http.StatusNotFound {
+		t.Errorf("POST should fall back to the module: %d", w.Code)
+	}
+}
+
+func TestStaticFilesRoot(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "public")
+	for name, content := range map[string]string{
+		"public/a.css":    "body{}",
+		"public/.env":     "SECRET=1",
+		"secret.txt":      "SECRET=2",
+		"public/sub/b.js": "b",
+	} {
+		name = filepath.Join(base, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"escape.txt": filepath.Join(base, "secret.txt"),
+		"outside":    base,
+		"env.txt":    filepath.Join(dir, ".env"),
+		"inside.css": filepath.Join(dir, "a.css"),
+		"linked":     filepath.Join(dir, "sub"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// DOCUMENT_ROOT 由查找模块时设置, 没有对应的模块时也会查找静态文件
+	res := wagi.ResolverFunc(func(r *http.Request, params map[string]string) (*wagi.Script, error) {
+		params["DOCUMENT_ROOT"] = dir
+		return nil, fmt.Errorf("%w: module", wagi.ErrScriptNotFound)
+	})
+	ctx := context.Background()
+	s, err := wagi.New(ctx,
+		wagi.WithResolver(res),
+		wagi.WithParams(wagi.EmptyParams),
+		wagi.WithStaticFiles(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(ctx)
+
+	for p, want := range map[string]string{"/a.css": "body{}", "/inside.css": "body{}", "/linked/b.js": "b"} {
+		if w := do(s, "GET", p); w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("GET %s: %d %q", p, w.Code, w.Body.String())
+		}
+	}
+	// 通过符号链接指向 DOCUMENT_ROOT 之外或隐藏文件的路径不会响应
+	for _, p := range []string{"/escape.txt", "/outside/secret.txt", "/env.txt", "/../secret.txt"} {
+		if w := do(s, "GET", p); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s should fall back to the module: %d %q", p, w.Code, w.Body.String())
+		}
+	}
+}
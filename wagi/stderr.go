@@ -0,0 +1,145 @@
+package wagi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// StderrRouter 按行捕获 guest 的 stderr, 并带上脚本路径和请求 id 输出到日志
+//
+// Dir 为空时输出到 Logger (为 nil 时使用 [slog.Default]), 否则每个脚本按完整路径写入 Dir 下单独的日志文件并按大小轮转,
+// 如 /srv/www/index.wasm 写入 Dir/srv/www/index.wasm.log. 脚本的所有 Writer 都关闭后关闭日志文件
+type StderrRouter struct {
+	Logger     *slog.Logger
+	Dir        string
+	MaxSize    int // megabytes
+	MaxBackups int
+
+	files map[string]*stderrFile
+	mux   sync.Mutex
+}
+
+type stderrFile struct {
+	logger *slog.Logger
+	w      *lumberjack.Logger
+	refs   int // 未关闭的 Writer 数
+}
+
+// Writer 返回给 guest 使用的 stderr, 使用完毕后需要 Close 以输出最后不完整的一行
+func (sr *StderrRouter) Writer(script string, attrs ...any) io.WriteCloser {
+	logger, release := sr.logger(script)
+	logger = logger.With(attrs...)
+	return &lineWriter{
+		emit: func(line string) {
+			logger.Info(line)
+		},
+		release: release,
+	}
+}
+
+func (sr *StderrRouter) logger(script string) (*slog.Logger, func()) {
+	if sr.Dir == "" {
+		logger := sr.Logger
+		if logger == nil {
+			logger = slog.Default()
+		}
+		return logger.With("script", script), func() {}
+	}
+	sr.mux.Lock()
+	defer sr.mux.Unlock()
+	if sr.files == nil {
+		sr.files = map[string]*stderrFile{}
+	}
+	f, ok := sr.files[script]
+	if !ok {
+		// 以 / 开头再 Clean, 使 .. 不会跳出 Dir
+		name := path.Clean("/" + filepath.ToSlash(script))
+		w := &lumberjack.Logger{
+			Filename:   filepath.Join(sr.Dir, filepath.FromSlash(name)+".log"),
+			MaxSize:    sr.MaxSize,
+			MaxBackups: sr.MaxBackups,
+		}
+		f = &stderrFile{
+			logger: slog.New(slog.NewTextHandler(w, nil)).With("script", script),
+			w:      w,
+		}
+		sr.files[script] = f
+	}
+	f.refs++
+	return f.logger, func() {
+		sr.mux.Lock()
+		defer sr.mux.Unlock()
+		if f.refs--; f.refs == 0 {
+			delete(sr.files, script)
+			f.w.Close()
+		}
+	}
+}
+
+// maxLineSize 是缓存的不完整行的最大字节数, 超过时直接输出, 避免不换行的 guest 占用过多内存
+const maxLineSize = 64 << 10
+
+type lineWriter struct {
+	emit    func(line string)
+	release func()
+	buf     []byte
+	closed  bool
+	mux     sync.Mutex
+}
+
+var _ io.WriteCloser = (*lineWriter)(nil)
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.closed {
+		return len(p), nil
+	}
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(string(bytes.TrimSuffix(w.buf[:i], []byte("\r"))))
+		w.buf = w.buf[i+1:]
+	}
+	if len(w.buf) >= maxLineSize {
+		w.emit(string(w.buf))
+		w.buf = nil
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) Close() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if len(w.buf) > 0 {
+		w.emit(string(w.buf))
+		w.buf = nil
+	}
+	w.release()
+	return nil
+}
+
+// requestID 优先使用前置代理传入的 X-Request-Id
+func requestID(env map[string]string) string {
+	if id := env["HTTP_X_REQUEST_ID"]; id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,61 @@
+package wagi_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/shynome/go-wagi/wagi"
+)
+
+func TestStderrRouter(t *testing.T) {
+	dir := t.TempDir()
+	sr := &wagi.StderrRouter{Dir: dir}
+	// 替换 / 后会重名的脚本写入不同的文件
+	scripts := map[string]string{
+		"/srv/a/b_c.wasm":            "srv/a/b_c.wasm.log",
+		"/srv/a_b/c.wasm":            "srv/a_b/c.wasm.log",
+		"../../etc/x.wasm":           "etc/x.wasm.log",
+		"https://example.com/a.wasm": "https:/example.com/a.wasm.log",
+	}
+	for script := range scripts {
+		w1 := sr.Writer(script, "request_id", "1")
+		w2 := sr.Writer(script, "request_id", "2")
+		fmt.Fprint(w1, "hello ")
+		fmt.Fprint(w2, "second\n")
+		fmt.Fprint(w1, "world\npartial")
+		w1.Close()
+		w2.Close()
+		// 关闭后的写入被忽略
+		fmt.Fprint(w1, "ignored\n")
+	}
+	for script, name := range scripts {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("%s: %v", script, err)
+		}
+		log := string(b)
+		for _, want := range []string{"msg=second", `msg="hello world"`, "msg=partial", "script=" + script} {
+			if !strings.Contains(log, want) {
+				t.Errorf("%s: %q not found in\n%s", script, want, log)
+			}
+		}
+		if strings.Contains(log, "ignored") {
+			t.Errorf("%s: write after close should be dropped", script)
+		}
+	}
+
+	// 没有换行的长输出超过上限时直接输出
+	w := sr.Writer("/long.wasm")
+	defer w.Close()
+	fmt.Fprint(w, strings.Repeat("x", 100<<10))
+	b, err := os.ReadFile(filepath.Join(dir, "long.wasm.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "\n"); n != 1 {
+		t.Errorf("long output: %d lines, want 1 before close", n)
+	}
+}
@@ -0,0 +1,106 @@
+// guest 是测试用的模块, 通过请求触发各种情况
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/shynome/wcgi"
+)
+
+var (
+	id      = rand.Text() // 每个实例不同
+	sick    atomic.Bool
+	counter atomic.Int64
+	hold    [][]byte
+)
+
+func init() {
+	http.HandleFunc("/id", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, id)
+	})
+	// 路由的前缀不会被去掉, 其他路径也返回环境变量
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, os.Getenv(r.URL.Query().Get("k")))
+	})
+	http.HandleFunc("/count", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, counter.Add(1))
+	})
+	// 按 h 参数设置响应头, 响应体带递增的计数, 用于区分是否命中响应缓存
+	http.HandleFunc("/cache/", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		for _, h := range q["h"] {
+			k, v, _ := strings.Cut(h, ":")
+			w.Header().Add(k, v)
+		}
+		pad, _ := strconv.Atoi(q.Get("pad"))
+		fmt.Fprintf(w, "%d %s%s", counter.Add(1), r.Header.Get("Accept-Language"), strings.Repeat(" ", pad))
+	})
+	// 先发送 103 Early Hints, 再发送可以压缩的响应, 同样按 h 参数设置响应头
+	http.HandleFunc("/early", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</a.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		for _, h := range r.URL.Query()["h"] {
+			k, v, _ := strings.Cut(h, ":")
+			w.Header().Add(k, v)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, strings.Repeat(id, 60))
+	})
+	http.HandleFunc("/sleep", func(w http.ResponseWriter, r *http.Request) {
+		d, _ := time.ParseDuration(r.URL.Query().Get("d"))
+		time.Sleep(d)
+		fmt.Fprint(w, id)
+	})
+	// 分配并持有内存, 使线性内存增长
+	http.HandleFunc("/grow", func(w http.ResponseWriter, r *http.Request) {
+		hold = append(hold, make([]byte, 16<<20))
+		fmt.Fprint(w, id)
+	})
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if sick.Load() {
+			http.Error(w, "sick", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+	http.HandleFunc("/sick", func(w http.ResponseWriter, r *http.Request) {
+		sick.Store(true)
+		fmt.Fprint(w, id)
+	})
+	// wasm 中没有抢占, 死循环会让实例不再响应 ping
+	http.HandleFunc("/spin", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, id)
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			for {
+			}
+		}()
+	})
+	// 指定的实例正常退出, 不算作 trap
+	http.HandleFunc("/exit", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("id") == id {
+			os.Exit(0)
+		}
+		fmt.Fprint(w, id)
+	})
+	http.HandleFunc("/crash", func(w http.ResponseWriter, r *http.Request) {
+		counter.Add(1)
+		go panic("crash")
+		time.Sleep(time.Second)
+	})
+}
+
+func main() {
+	// 测试通过日志统计启动的实例数
+	fmt.Fprintln(os.Stderr, "guest started")
+	if err := wcgi.Serve(nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
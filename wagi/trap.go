@@ -0,0 +1,32 @@
+package wagi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// ErrGuestTrapped 表示 wcgi 实例因 trap (如内存越界, unreachable) 或非 0 退出码退出, 会响应 502
+var ErrGuestTrapped = errors.New("guest trapped")
+
+// trapError 返回 guest 异常退出的原因, 正常退出和被关闭时返回 nil
+func trapError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() != nil {
+		return nil
+	}
+	var exit *sys.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %w", ErrGuestTrapped, err)
+}
+
+// Trap 返回实例异常退出的原因, 实例仍在运行或正常退出时返回 nil
+func (p *ProxyItem) Trap() error {
+	if err := p.trap.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package wagi_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTrap(t *testing.T) {
+	s, log := newGuestServer(t)
+	trapped := func() int { return log.Count("wcgi instance trapped") }
+	started := func() int { return log.Count("guest started") }
+
+	// GET 和 HEAD 在新的实例上重试一次
+	for i, method := range []string{"GET", "HEAD"} {
+		w := do(s, method, "/crash")
+		if w.Code != http.StatusBadGateway || strings.Contains(w.Body.String(), "crash") {
+			t.Errorf("%s: %d %q, want 502 without details", method, w.Code, w.Body)
+		}
+		if n := trapped(); n != 2*(i+1) {
+			t.Errorf("%s: %d traps, want %d", method, n, 2*(i+1))
+		}
+		if n := started(); n != 2*(i+1) {
+			t.Errorf("%s: %d instances started, want %d", method, n, 2*(i+1))
+		}
+	}
+
+	// trap 后的实例被移除, 下一个请求启动新的实例
+	if w := do(s, "GET", "/id"); w.Code != http.StatusOK {
+		t.Fatalf("after trap: %d %s", w.Code, w.Body)
+	}
+	if n := started(); n != 5 {
+		t.Errorf("%d instances started, want 5", n)
+	}
+
+	// POST 不重试
+	for _, body := range []string{"", "body"} {
+		before := trapped()
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/crash", strings.NewReader(body)))
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("POST %q: %d, want 502", body, w.Code)
+		}
+		if n := trapped() - before; n != 1 {
+			t.Errorf("POST %q: trapped %d times, want 1", body, n)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package wagi
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// VirtualHost 是按域名选择的站点配置, 多个租户可以共用一个 go-wagi 进程而互相隔离
+//
+// 站点配置优先于前置代理传入的 fastcgi 参数
+type VirtualHost struct {
+	// Names 是站点的域名, 支持 `*.example.com` 形式的通配符, `*` 匹配所有域名
+	Names []string `yaml:"names" json:"names"`
+	// Root 是站点的 DOCUMENT_ROOT
+	Root string `yaml:"root" json:"root"`
+	// Script 是站点的默认脚本, 相对路径基于 Root.
+	// 没有 SCRIPT_FILENAME 或 SCRIPT_FILENAME 不在 Root 中时使用
+	Script string            `yaml:"script" json:"script"`
+	Env    map[string]string `yaml:"env" json:"env"`
+	Net    string            `yaml:"net" json:"net"`
+	Mode   string            `yaml:"mode" json:"mode"`
+	Limits Limits            `yaml:"limits" json:"limits"`
+}
+
+// Limits 是单个请求的资源限制, 零值表示不限制
+type Limits struct {
+	// Timeout 是请求的最长处理时间, 超时后 cgi 实例会被终止
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+	// MaxBodySize 是请求体的最大字节数, 超过时响应 413
+	MaxBodySize int64 `yaml:"max_body_size" json:"max_body_size"`
+}
+
+func (vh *VirtualHost) Validate() error {
+	if len(vh.Names) == 0 {
+		return fmt.Errorf("virtual host requires names")
+	}
+	switch vh.Mode {
+	case "", "cgi", "wcgi":
+	default:
+		return fmt.Errorf("virtual host %s: unknown mode %q", vh.Names[0], vh.Mode)
+	}
+	return nil
+}
+
+func (vh *VirtualHost) match(host string) bool {
+	for _, name := range vh.Names {
+		switch {
+		case name == "*":
+			return true
+		case strings.HasPrefix(name, "*."):
+			if strings.HasSuffix(host, name[1:]) {
+				return true
+			}
+		case strings.EqualFold(name, host):
+			return true
+		}
+	}
+	return false
+}
+
+// apply 将站点配置写入 fastcgi 参数
+func (vh *VirtualHost) apply(params map[string]string) {
+	if vh.Root != "" {
+		params["DOCUMENT_ROOT"] = vh.Root
+	}
+	if script := vh.Script; script != "" {
+		if !filepath.IsAbs(script) && vh.Root != "" {
+			script = filepath.Join(vh.Root, script)
+		}
+		current := params["SCRIPT_FILENAME"]
+		if current == "" || (vh.Root != "" && !inDir(vh.Root, current)) {
+			params["SCRIPT_FILENAME"] = script
+		}
+	}
+	if vh.Net != "" {
+		params["WASI_NET"] = vh.Net
+	}
+	switch vh.Mode {
+	case "cgi":
+		params["WASI_CGI"] = "true"
+	case "wcgi":
+		delete(params, "WASI_CGI")
+	}
+	for k, v := range vh.Env {
+		params[k] = v
+	}
+	addInstanceKey(params, "host:"+strings.Join(vh.Names, ","), vh.Env)
+}
+
+// instanceParam 记录请求匹配的站点和路由, 不同站点和路由的请求不会共用实例, 不会传递给 guest
+const instanceParam = "WAGI_INSTANCE"
+
+// addInstanceKey 将站点或路由的标识和环境变量的摘要加入实例的 key,
+// 避免共用一个脚本的租户拿到先启动实例的环境变量
+func addInstanceKey(params map[string]string, id string, env map[string]string) {
+	h := sha256.New()
+	io.WriteString(h, id)
+	for _, k := range sortedKeys(env) {
+		fmt.Fprintf(h, "\x00%s=%s", k, env[k])
+	}
+	key := fmt.Sprintf("%x", h.Sum(nil)[:8])
+	if prev := params[instanceParam]; prev != "" {
+		key = prev + "+" + key
+	}
+	params[instanceParam] = key
+}
+
+// limit 按 Limits 限制请求, 请求体过大时响应 413 并返回 false
+func (l Limits) limit(w http.ResponseWriter, r *http.Request) (*http.Request, context.CancelFunc, bool) {
+	cancel := context.CancelFunc(func() {})
+	if l.MaxBodySize > 0 {
+		if r.ContentLength > l.MaxBodySize {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return r, cancel, false
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, l.MaxBodySize)
+	}
+	if l.Timeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(r.Context(), l.Timeout)
+		r = r.WithContext(ctx)
+	}
+	return r, cancel, true
+}
+
+// virtualHost 按 HTTP_HOST, SERVER_NAME 和请求的 Host 选择站点
+func (s *Server) virtualHost(r *http.Request, params map[string]string) *VirtualHost {
+	if len(s.vhosts) == 0 {
+		return nil
+	}
+	host := requestHost(r, params)
+	for i := range s.vhosts {
+		if vh := &s.vhosts[i]; vh.match(host) {
+			return vh
+		}
+	}
+	return nil
+}
+
+// requestHost 返回不含端口的请求域名
+func requestHost(r *http.Request, params map[string]string) string {
+	host := params["HTTP_HOST"]
+	if host == "" {
+		host = params["SERVER_NAME"]
+	}
+	if host == "" {
+		host = r.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+func inDir(dir, file string) bool {
+	rel, err := filepath.Rel(dir, file)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
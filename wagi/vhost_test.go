@@ -0,0 +1,85 @@
+package wagi_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/shynome/go-wagi/wagi"
+)
+
+func TestVirtualHosts(t *testing.T) {
+	var got map[string]string
+	// resolver 记录站点写入的参数后响应 404
+	res := wagi.ResolverFunc(func(r *http.Request, params map[string]string) (*wagi.Script, error) {
+		got = params
+		return nil, fmt.Errorf("%w: test", wagi.ErrScriptNotFound)
+	})
+	ctx := context.Background()
+	s, err := wagi.New(ctx,
+		wagi.WithResolver(res),
+		wagi.WithParams(wagi.EmptyParams),
+		wagi.WithVirtualHosts(
+			wagi.VirtualHost{Names: []string{"a.example.com", "*.a.example.com"}, Root: "/srv/a", Script: "index.wasm", Net: "bypass=127.0.0.1", Env: map[string]string{"TENANT": "a"}, Limits: wagi.Limits{MaxBodySize: 4}},
+			wagi.VirtualHost{Names: []string{"*"}, Root: "/srv/default", Mode: "cgi"},
+		),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(ctx)
+
+	cases := []struct {
+		url, root, script, tenant string
+	}{
+		{"http://a.example.com/", "/srv/a", "/srv/a/index.wasm", "a"},
+		{"http://x.a.example.com:8080/", "/srv/a", "/srv/a/index.wasm", "a"},
+		{"http://b.example.com/", "/srv/default", "", ""},
+	}
+	for _, c := range cases {
+		got = nil
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", c.url, nil))
+		if got["DOCUMENT_ROOT"] != c.root || got["SCRIPT_FILENAME"] != c.script || got["TENANT"] != c.tenant {
+			t.Errorf("%s: DOCUMENT_ROOT %q SCRIPT_FILENAME %q TENANT %q", c.url, got["DOCUMENT_ROOT"], got["SCRIPT_FILENAME"], got["TENANT"])
+		}
+	}
+	if got["WASI_CGI"] != "true" {
+		t.Errorf("default host should force cgi")
+	}
+
+	// 前置代理传入的 SCRIPT_FILENAME 不在站点目录中时使用默认脚本
+	got = nil
+	r := httptest.NewRequest("GET", "http://a.example.com/", nil)
+	s.ServeParams(httptest.NewRecorder(), r, map[string]string{"SCRIPT_FILENAME": "/srv/b/index.wasm"})
+	if got["SCRIPT_FILENAME"] != "/srv/a/index.wasm" {
+		t.Errorf("SCRIPT_FILENAME %q", got["SCRIPT_FILENAME"])
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "http://a.example.com/", strings.NewReader("too large")))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413", w.Code)
+	}
+}
+
+func TestVirtualHostsIsolateInstances(t *testing.T) {
+	// 两个站点使用同一个脚本, 环境变量不同
+	s, _ := newGuestServer(t, wagi.WithVirtualHosts(
+		wagi.VirtualHost{Names: []string{"a.example.com"}, Env: map[string]string{"TENANT": "a"}},
+		wagi.VirtualHost{Names: []string{"b.example.com"}, Env: map[string]string{"TENANT": "b"}},
+	))
+	for range 2 {
+		for _, tenant := range []string{"a", "b"} {
+			w := do(s, "GET", "http://"+tenant+".example.com/?k=TENANT")
+			if w.Code != http.StatusOK || w.Body.String() != tenant {
+				t.Fatalf("%s: %d %q", tenant, w.Code, w.Body.String())
+			}
+		}
+	}
+	if n := len(s.Scripts()); n != 2 {
+		t.Errorf("%d instances, want 2", n)
+	}
+}
@@ -0,0 +1,316 @@
+// Package wagi 实现了 go-wagi 的 wasm cgi 服务, 可以作为 [http.Handler] 挂载到任意 mux 中
+//
+//	s, err := wagi.New(ctx, wagi.WithCacheDir(".wazero"))
+//	if err != nil {
+//		return err
+//	}
+//	defer s.Close(ctx)
+//	fcgi.Serve(l, s)
+//
+// 脚本路径等参数默认从 fastcgi 参数中读取, 直接提供 http 服务时可以通过 [WithParams] 指定
+package wagi
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/fcgi"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"go.opentelemetry.io/otel"
+)
+
+var tracer = otel.Tracer("github.com/shynome/go-wagi/wagi")
+
+// ParamsFunc 返回请求对应的 fastcgi 参数, 至少需要包含 SCRIPT_FILENAME
+type ParamsFunc func(r *http.Request) map[string]string
+
+// FastCGIParams 从 fastcgi 请求中读取参数, 是默认的 [ParamsFunc]
+func FastCGIParams(r *http.Request) map[string]string {
+	return fcgi.ProcessEnv(r)
+}
+
+// EmptyParams 不提供任何参数, 用于直接提供 http 服务, 由 [Resolver] 根据请求设置参数
+func EmptyParams(r *http.Request) map[string]string {
+	return map[string]string{}
+}
+
+// ScriptParams 总是运行 script, 用于在非 fastcgi 的 http 服务中挂载
+func ScriptParams(script string, root string) ParamsFunc {
+	return func(r *http.Request) map[string]string {
+		return map[string]string{
+			"SCRIPT_FILENAME": script,
+			"DOCUMENT_ROOT":   root,
+		}
+	}
+}
+
+// Policy 是附加在 fastcgi 参数上的默认策略, 参数中已有的值优先
+type Policy struct {
+	Net      string            // 默认的 WASI_NET 网络规则
+	ForceCGI bool              // 默认的 WASI_CGI, 强制以 cgi 模式运行
+	Env      map[string]string // 额外的环境变量
+	Limits   RateLimits        // 限流和并发限制
+}
+
+func (p Policy) apply(params map[string]string) {
+	set := func(k, v string) {
+		if _, ok := params[k]; !ok && v != "" {
+			params[k] = v
+		}
+	}
+	set("WASI_NET", p.Net)
+	if p.ForceCGI {
+		set("WASI_CGI", "true")
+	}
+	for k, v := range p.Env {
+		set(k, v)
+	}
+}
+
+type Option func(s *Server)
+
+// WithRuntime 使用外部创建的 runtime, Close 时不会关闭它
+func WithRuntime(rt wazero.Runtime) Option {
+	return func(s *Server) { s.rt = rt }
+}
+
+// WithRuntimeConfig 指定创建 runtime 时使用的配置, 默认为 [wazero.NewRuntimeConfig]
+func WithRuntimeConfig(rtc wazero.RuntimeConfig) Option {
+	return func(s *Server) { s.rtc = rtc }
+}
+
+// WithCacheDir 指定 wazero 编译缓存目录, 为空时不使用缓存
+func WithCacheDir(dir string) Option {
+	return func(s *Server) { s.cacheDir = dir }
+}
+
+// WithKeepAlive 指定脚本空闲多久后释放, 默认为 10 分钟
+func WithKeepAlive(d time.Duration) Option {
+	return func(s *Server) { s.keepAlive = d }
+}
+
+// WithParams 指定如何从请求中读取 fastcgi 参数, 默认为 [FastCGIParams]
+func WithParams(params ParamsFunc) Option {
+	return func(s *Server) { s.params = params }
+}
+
+// WithResolver 指定如何查找请求对应的模块, 默认为 [LocalResolver]
+func WithResolver(res Resolver) Option {
+	return func(s *Server) { s.resolver = res }
+}
+
+// WithPolicy 指定附加在 fastcgi 参数上的默认策略
+func WithPolicy(p Policy) Option {
+	return func(s *Server) { s.policy = p }
+}
+
+// WithVirtualHosts 按域名选择站点配置, 按顺序匹配, 使用第一个匹配的站点
+func WithVirtualHosts(hosts ...VirtualHost) Option {
+	return func(s *Server) { s.vhosts = hosts }
+}
+
+// WithStaticFiles 在运行模块前先查找 DOCUMENT_ROOT 中的静态文件, 存在时直接响应,
+// 否则再交给模块处理 (类似 nginx 的 try_files). DOCUMENT_ROOT 以查找模块后的参数为准
+//
+// wasm 模块, 目录, 以 . 开头的文件和通过符号链接指向 DOCUMENT_ROOT 之外的文件不会作为静态文件响应
+func WithStaticFiles() Option {
+	return func(s *Server) { s.static = true }
+}
+
+// WithResponseCache 按 guest 响应的缓存头缓存响应, 命中时不再运行模块
+func WithResponseCache(rc *ResponseCache) Option {
+	return func(s *Server) { s.respCache = rc }
+}
+
+// WithCompression 根据 Accept-Encoding 压缩响应
+func WithCompression(c *Compression) Option {
+	return func(s *Server) { s.compression = c }
+}
+
+// WithBudget 限制所有脚本共享的实例数和内存
+func WithBudget(b Budget) Option {
+	return func(s *Server) { s.budget = b }
+}
+
+// CacheLimits 限制各个缓存的容量, 超过时按最近最少使用淘汰并释放被淘汰的模块和实例, 零值表示不限制
+type CacheLimits struct {
+	Modules     int   // 编译后的模块数
+	ModuleBytes int64 // 模块的总大小, 按 wasm 文件的大小计算
+	Instances   int   // 脚本数
+	Proxies     int   // wcgi 实例数
+}
+
+// WithCacheLimits 限制模块和实例缓存的容量
+func WithCacheLimits(l CacheLimits) Option {
+	return func(s *Server) { s.cacheLimits = l }
+}
+
+// WithHealthCheck 定时检查 wcgi 实例, 连续失败的实例会被关闭, 下一个请求会启动新的实例
+func WithHealthCheck(h HealthCheck) Option {
+	return func(s *Server) { s.health = h }
+}
+
+// WithRecycle 按请求数, 运行时间或内存重启 wcgi 实例
+func WithRecycle(rc Recycle) Option {
+	return func(s *Server) { s.recycle = rc }
+}
+
+// WithSnapshots 使导出了 [SnapshotInit] 的模块在 cgi 模式下从初始化后的快照启动
+func WithSnapshots() Option {
+	return func(s *Server) { s.snapshots = true }
+}
+
+// WithEngine 指定执行模块的方式, 默认为 [EngineAuto]. 解释执行使用单独创建的 runtime, 不受 [WithRuntime] 影响
+func WithEngine(e Engine) Option {
+	return func(s *Server) { s.engine = e }
+}
+
+// WithLogger 指定服务的日志, 默认为 [slog.Default]
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) { s.logger = logger }
+}
+
+// WithStderr 指定 guest stderr 的输出, 默认输出到服务的日志
+func WithStderr(sr *StderrRouter) Option {
+	return func(s *Server) { s.stderr = sr }
+}
+
+type Server struct {
+	rt          wazero.Runtime
+	ownRT       bool
+	rtc         wazero.RuntimeConfig
+	irt         func() (wazero.Runtime, error) // 解释执行的 runtime, 第一次使用时创建
+	irtOpen     atomic.Bool
+	guests      sync.WaitGroup // 运行中的 guest 和释放模块的 goroutine, 关闭 runtime 前需要等待
+	engine      Engine
+	cacheDir    string
+	keepAlive   time.Duration
+	params      ParamsFunc
+	resolver    Resolver
+	policy      Policy
+	vhosts      []VirtualHost
+	static      bool
+	respCache   *ResponseCache
+	compression *Compression
+	limiters    limiters
+	budget      Budget
+	budgetState budgetState
+	cacheLimits CacheLimits
+	health      HealthCheck
+	recycle     Recycle
+	snapshots   bool
+	logger      *slog.Logger
+	stderr      *StderrRouter
+
+	mCache     *Cache[func() (*WasmItem, error)]
+	proxyCache *Cache[func() (*ProxyItem, error)]
+	instCache  *Cache[*InstanceItem]
+	proxies    sync.Map // proxyKey -> 已启动的 *ProxyItem, 供缓存淘汰时不加锁地检查
+}
+
+var _ http.Handler = (*Server)(nil)
+
+func New(ctx context.Context, opts ...Option) (*Server, error) {
+	s := &Server{
+		keepAlive: 10 * time.Minute,
+		params:    FastCGIParams,
+		resolver:  LocalResolver{},
+
+		mCache:     NewCache[func() (*WasmItem, error)](),
+		proxyCache: NewCache[func() (*ProxyItem, error)](),
+		instCache:  NewCache[*InstanceItem](),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+	s.limiters = newLimiters(s.policy.Limits)
+	s.setupCaches()
+	if s.stderr == nil {
+		s.stderr = &StderrRouter{Logger: s.logger}
+	}
+	if s.rt == nil {
+		rt, err := NewRuntime(ctx, s.rtc, s.cacheDir)
+		if err != nil {
+			return nil, err
+		}
+		s.rt, s.ownRT = rt, true
+	}
+	if s.engine == "" {
+		s.engine = EngineAuto
+	}
+	// 只使用编译器时不需要创建
+	s.irt = sync.OnceValues(func() (wazero.Runtime, error) {
+		rt, err := NewRuntime(context.WithoutCancel(ctx), wazero.NewRuntimeConfigInterpreter(), "")
+		if err == nil {
+			s.irtOpen.Store(true)
+		}
+		return rt, err
+	})
+	if s.rt.Module(wasi_snapshot_preview1.ModuleName) == nil {
+		if err := instantiateWASI(ctx, s.rt); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// NewRuntime 创建一个关闭 context 时会中断 guest 的 runtime, cacheDir 为空时不使用编译缓存
+func NewRuntime(ctx context.Context, rtc wazero.RuntimeConfig, cacheDir string) (wazero.Runtime, error) {
+	if rtc == nil {
+		rtc = wazero.NewRuntimeConfig()
+	}
+	if cacheDir != "" {
+		cache, err := wazero.NewCompilationCacheWithDir(cacheDir)
+		if err != nil {
+			return nil, err
+		}
+		rtc = rtc.WithCompilationCache(cache)
+	}
+	rtc = rtc.WithCloseOnContextDone(true)
+	rt := wazero.NewRuntimeWithConfig(ctx, rtc)
+	if err := instantiateWASI(ctx, rt); err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	return rt, nil
+}
+
+// ResponseCache 返回 [WithResponseCache] 指定的响应缓存, 未启用时为 nil
+func (s *Server) ResponseCache() *ResponseCache {
+	return s.respCache
+}
+
+func (s *Server) Runtime() wazero.Runtime {
+	return s.rt
+}
+
+// Close 释放所有脚本的模块和实例, runtime 由 Server 创建时一并关闭.
+// 会等待 wcgi 实例退出和正在运行的 cgi 请求结束
+func (s *Server) Close(ctx context.Context) error {
+	for _, inst := range s.instCache.Items() {
+		inst.Close()
+	}
+	s.guests.Wait()
+	if s.irtOpen.Load() {
+		if irt, err := s.irt(); err == nil {
+			irt.Close(ctx)
+		}
+	}
+	if s.ownRT {
+		return s.rt.Close(ctx)
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := s.params(r)
+	s.ServeParams(w, r, params)
+}
@@ -0,0 +1,228 @@
+package wagi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+)
+
+// wasm 二进制的 section id
+const (
+	secImport = 2
+	secGlobal = 6
+	secExport = 7
+)
+
+type wasmSection struct {
+	id      byte
+	payload []byte
+}
+
+type wasmReader struct {
+	b   []byte
+	off int
+}
+
+var errWasmEOF = errors.New("unexpected end of wasm binary")
+
+func (r *wasmReader) byte() byte {
+	if r.off >= len(r.b) {
+		panic(errWasmEOF)
+	}
+	c := r.b[r.off]
+	r.off++
+	return c
+}
+
+func (r *wasmReader) bytes(n int) []byte {
+	if n < 0 || r.off+n > len(r.b) {
+		panic(errWasmEOF)
+	}
+	p := r.b[r.off : r.off+n]
+	r.off += n
+	return p
+}
+
+// leb 读取一个 LEB128 编码的整数, 有符号数只需要跳过, 不关心其值
+func (r *wasmReader) leb() uint64 {
+	var v uint64
+	for shift := 0; ; shift += 7 {
+		c := r.byte()
+		if shift < 64 {
+			v |= uint64(c&0x7f) << shift
+		}
+		if c&0x80 == 0 {
+			return v
+		}
+	}
+}
+
+func (r *wasmReader) name() string {
+	return string(r.bytes(int(r.leb())))
+}
+
+func (r *wasmReader) limits() {
+	flags := r.byte()
+	r.leb()
+	if flags&1 != 0 {
+		r.leb()
+	}
+}
+
+// constExpr 跳过全局变量的初始化表达式
+func (r *wasmReader) constExpr() {
+	for {
+		switch op := r.byte(); op {
+		case 0x0b: // end
+			return
+		case 0x41, 0x42, 0x23, 0xd2: // i32.const, i64.const, global.get, ref.func
+			r.leb()
+		case 0x43: // f32.const
+			r.bytes(4)
+		case 0x44: // f64.const
+			r.bytes(8)
+		case 0xd0: // ref.null
+			r.byte()
+		case 0xfd: // v128.const
+			r.leb()
+			r.bytes(16)
+		case 0x6a, 0x6b, 0x6c, 0x7c, 0x7d, 0x7e: // extended-const
+		default:
+			panic(fmt.Errorf("unsupported opcode 0x%x in const expr", op))
+		}
+	}
+}
+
+func appendLEB(b []byte, v uint64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func parseSections(bin []byte) (_ []wasmSection, err error) {
+	defer recoverWasm(&err)
+	if len(bin) < 8 || !isWasm(bytes.NewReader(bin)) || binary.LittleEndian.Uint32(bin[4:8]) != 1 {
+		return nil, errors.New("not a wasm module")
+	}
+	r := &wasmReader{b: bin, off: 8}
+	var sections []wasmSection
+	for r.off < len(r.b) {
+		id := r.byte()
+		sections = append(sections, wasmSection{id: id, payload: r.bytes(int(r.leb()))})
+	}
+	return sections, nil
+}
+
+func recoverWasm(err *error) {
+	if v := recover(); v != nil {
+		e, ok := v.(error)
+		if !ok {
+			panic(v)
+		}
+		*err = fmt.Errorf("parse wasm: %w", e)
+	}
+}
+
+// exportGlobals 导出模块中所有可变的数值类型全局变量, 以便在快照时读取和恢复.
+// 返回新的模块和导出的名称, 模块没有导出 init 函数时返回 nil
+func exportGlobals(bin []byte, init string) (_ []byte, names []string, err error) {
+	sections, err := parseSections(bin)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer recoverWasm(&err)
+
+	var (
+		imported int
+		globals  []int // 需要导出的全局变量的索引
+		exports  = -1
+		found    bool
+	)
+	for i, sec := range sections {
+		r := &wasmReader{b: sec.payload}
+		switch sec.id {
+		case secImport:
+			for n := r.leb(); n > 0; n-- {
+				r.name()
+				r.name()
+				switch kind := r.byte(); kind {
+				case 0: // func
+					r.leb()
+				case 1: // table
+					r.byte()
+					r.limits()
+				case 2: // memory
+					r.limits()
+				case 3: // global
+					r.bytes(2)
+					imported++
+				case 4: // tag
+					r.byte()
+					r.leb()
+				default:
+					return nil, nil, fmt.Errorf("unknown import kind 0x%x", kind)
+				}
+			}
+		case secGlobal:
+			n := int(r.leb())
+			for idx := imported; idx < imported+n; idx++ {
+				typ, mut := r.byte(), r.byte()
+				r.constExpr()
+				if mut == 0 {
+					continue
+				}
+				switch typ {
+				case 0x7f, 0x7e, 0x7d, 0x7c: // i32, i64, f32, f64
+					globals = append(globals, idx)
+				default:
+					return nil, nil, fmt.Errorf("unsupported type 0x%x of mutable global %d", typ, idx)
+				}
+			}
+		case secExport:
+			exports = i
+			for n := r.leb(); n > 0; n-- {
+				name := r.name()
+				kind := r.byte()
+				r.leb()
+				if name == init && kind == 0 {
+					found = true
+				}
+			}
+		}
+	}
+	if !found {
+		return nil, nil, nil
+	}
+
+	var added []byte
+	for _, idx := range globals {
+		name := "wagi.global." + strconv.Itoa(idx)
+		names = append(names, name)
+		added = appendLEB(added, uint64(len(name)))
+		added = append(added, name...)
+		added = append(added, 3)
+		added = appendLEB(added, uint64(idx))
+	}
+	r := &wasmReader{b: sections[exports].payload}
+	n := r.leb()
+	payload := appendLEB(nil, n+uint64(len(globals)))
+	payload = append(payload, r.b[r.off:]...)
+	payload = append(payload, added...)
+	sections[exports].payload = payload
+
+	out := bytes.NewBuffer(slices.Clone(bin[:8]))
+	for _, sec := range sections {
+		out.WriteByte(sec.id)
+		out.Write(appendLEB(nil, uint64(len(sec.payload))))
+		out.Write(sec.payload)
+	}
+	return out.Bytes(), names, nil
+}